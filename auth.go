@@ -0,0 +1,132 @@
+/*
+   Copyright 2018 Docker, Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package httpnpipe
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// Authenticator carries out a connection-bound HTTP authentication scheme,
+// such as Negotiate or NTLM, for a Transport.
+type Authenticator interface {
+	// Scheme is the name of the scheme, as in the WWW-Authenticate and
+	// Authorization headers, such as "Negotiate".
+	Scheme() string
+	// NewSession starts a handshake with the server on pipeName, the
+	// pipe of serviceName.
+	NewSession(serviceName, pipeName string) (AuthSession, error)
+}
+
+// AuthSession is one handshake of an Authenticator, over one connection.
+type AuthSession interface {
+	// Step takes the token of the server's latest challenge, nil before
+	// the first, and returns the token to answer it with.
+	Step(challenge []byte) ([]byte, error)
+	// Close releases the session once the handshake is over.
+	Close() error
+}
+
+// maxAuthLegs bounds the round trips of a handshake. Negotiate and NTLM
+// take two or three.
+const maxAuthLegs = 10
+
+// authenticate answers resp, a 401 to req over pc, with the handshake of
+// the Transport's Authenticator, over pc, and returns the response to the
+// last leg. resp is returned as it is if it does not ask for the scheme, or
+// req cannot be sent again.
+func (transport *Transport) authenticate(ctx context.Context, pc *persistConn, req *http.Request, resp *http.Response) (*http.Response, error) {
+	auth := transport.Authenticator
+	challenge, ok := authChallenge(resp, auth.Scheme())
+	if !ok || (hasBody(req) && req.GetBody == nil) {
+		return resp, nil
+	}
+	session, err := auth.NewSession(pc.service, pc.pipeName)
+	if err != nil {
+		resp.Body.Close()
+		return nil, fmt.Errorf("%w: %s: %v", ErrAuthFailed, auth.Scheme(), err)
+	}
+	defer session.Close()
+
+	for leg := 0; leg < maxAuthLegs; leg++ {
+		token, err := session.Step(challenge)
+		// The connection has to be free again for the next leg, so what
+		// the server sent with its challenge is read and done with; it is
+		// kept out of the pool meanwhile, being pc.hold.
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s: %v", ErrAuthFailed, auth.Scheme(), err)
+		}
+		if !transport.takeHeldConn(pc) {
+			return nil, fmt.Errorf("%w: %s: the connection was closed midway", ErrAuthFailed, auth.Scheme())
+		}
+		out, err := rewindBody(req)
+		if err != nil {
+			pc.close()
+			return nil, err
+		}
+		out = cloneRequest(out)
+		out.Header = req.Header.Clone()
+		out.Header.Set("Authorization", auth.Scheme()+" "+base64.StdEncoding.EncodeToString(token))
+		resp, err = transport.roundTrip(ctx, pc, out)
+		var stale *staleConnError
+		if errors.As(err, &stale) {
+			err = stale.err
+		}
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusUnauthorized {
+			return resp, nil
+		}
+		if challenge, ok = authChallenge(resp, auth.Scheme()); !ok || len(challenge) == 0 {
+			// Turned down.
+			return resp, nil
+		}
+	}
+	return resp, nil
+}
+
+// authChallenge finds the challenge for scheme in the WWW-Authenticate
+// headers of resp, and returns its token, which is nil for a bare offer of
+// the scheme.
+func authChallenge(resp *http.Response, scheme string) ([]byte, bool) {
+	for _, v := range resp.Header.Values("Www-Authenticate") {
+		for _, c := range strings.Split(v, ",") {
+			name, param, _ := strings.Cut(strings.TrimSpace(c), " ")
+			if !strings.EqualFold(name, scheme) {
+				continue
+			}
+			param = strings.TrimSpace(param)
+			if param == "" {
+				return nil, true
+			}
+			token, err := base64.StdEncoding.DecodeString(param)
+			if err != nil {
+				return nil, false
+			}
+			return token, true
+		}
+	}
+	return nil, false
+}
@@ -0,0 +1,136 @@
+/*
+   Copyright 2018 Docker, Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package httpnpipe
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+)
+
+// testAuthenticator runs a two-leg handshake of scheme "Test", calling
+// onStep, if set, before each leg.
+type testAuthenticator struct {
+	onStep func()
+}
+
+func (a *testAuthenticator) Scheme() string { return "Test" }
+
+func (a *testAuthenticator) NewSession(serviceName, pipeName string) (AuthSession, error) {
+	return &testAuthSession{onStep: a.onStep}, nil
+}
+
+type testAuthSession struct {
+	onStep func()
+}
+
+func (s *testAuthSession) Step(challenge []byte) ([]byte, error) {
+	if s.onStep != nil {
+		s.onStep()
+	}
+	switch string(challenge) {
+	case "":
+		return []byte("hello"), nil
+	case "challenge":
+		return []byte("answer"), nil
+	}
+	return nil, fmt.Errorf("unexpected challenge %q", challenge)
+}
+
+func (s *testAuthSession) Close() error { return nil }
+
+// serveTestAuth serves the server side of testAuthenticator's handshake,
+// which only holds together over one connection, with no other request in
+// between. /public needs no authentication.
+func serveTestAuth(c net.Conn) {
+	token := func(s string) string { return "Test " + base64.StdEncoding.EncodeToString([]byte(s)) }
+	br := bufio.NewReader(c)
+	challenged := false
+	for {
+		req, err := http.ReadRequest(br)
+		if err != nil {
+			return
+		}
+		io.Copy(io.Discard, req.Body)
+		var reply string
+		switch auth := req.Header.Get("Authorization"); {
+		case req.URL.Path == "/public":
+			challenged = false
+			reply = "HTTP/1.1 200 OK\r\nContent-Length: 6\r\n\r\npublic"
+		case auth == token("hello"):
+			challenged = true
+			reply = "HTTP/1.1 401 Unauthorized\r\nWWW-Authenticate: " + token("challenge") + "\r\nContent-Length: 0\r\n\r\n"
+		case auth == token("answer") && challenged:
+			challenged = false
+			reply = "HTTP/1.1 200 OK\r\nContent-Length: 6\r\n\r\nsecret"
+		default:
+			challenged = false
+			reply = "HTTP/1.1 401 Unauthorized\r\nWWW-Authenticate: Test\r\nContent-Length: 0\r\n\r\n"
+		}
+		if _, err := io.WriteString(c, reply); err != nil || req.Close {
+			return
+		}
+	}
+}
+
+func TestAuthenticateKeepsConnOutOfPool(t *testing.T) {
+	tests := []struct {
+		name    string
+		maxIdle int
+		busy    bool
+	}{
+		{"other requests meanwhile", 1, true},
+		{"no idle connections kept", -1, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pipes := &fakePipes{serve: serveTestAuth}
+			auth := &testAuthenticator{}
+			transport := &Transport{Authenticator: auth, MaxIdleConnsPerService: tt.maxIdle}
+			defer transport.Close()
+			if err := transport.RegisterTargetDialer("svc", pipes.dial); err != nil {
+				t.Fatal(err)
+			}
+			client := &http.Client{Transport: transport}
+			if tt.busy {
+				// Other requests come and go during the handshake, and
+				// must neither take its connection nor crowd it out of
+				// the pool.
+				auth.onStep = func() {
+					if body, err := getBody(client, "http+npipe://svc/public"); err != nil || body != "public" {
+						t.Errorf("request during the handshake: %q, %v", body, err)
+					}
+				}
+			}
+			body, err := getBody(client, "http+npipe://svc/private")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if body != "secret" {
+				t.Errorf("body %q, want %q", body, "secret")
+			}
+			transport.CloseIdleConnections()
+			if n := pipes.leaked(); n != 0 {
+				t.Errorf("%d connections left open", n)
+			}
+		})
+	}
+}
@@ -0,0 +1,56 @@
+/*
+   Copyright 2018 Docker, Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package httpnpipe
+
+import (
+	"context"
+	"net"
+)
+
+// closeWriter is implemented by connections that can be half-closed, such
+// as message-mode named pipes.
+type closeWriter interface {
+	CloseWrite() error
+}
+
+type closeWriteKey struct{}
+
+// WithCloseWrite returns a copy of ctx that asks the Transport to half-close
+// the pipe connection of a request made with it as soon as the request body
+// has been sent, while the response is still read as usual. This is how a
+// client signals the end of its input to servers that stream, such as a
+// docker exec reading stdin. The connection is not reused afterwards.
+//
+// Only connections that support half-closing can be used this way; for
+// others the request fails with ErrCloseWriteUnsupported.
+func WithCloseWrite(ctx context.Context) context.Context {
+	return context.WithValue(ctx, closeWriteKey{}, true)
+}
+
+func wantsCloseWrite(ctx context.Context) bool {
+	want, _ := ctx.Value(closeWriteKey{}).(bool)
+	return want
+}
+
+// closeWrite half-closes c.
+func closeWrite(c net.Conn) error {
+	cw, ok := c.(closeWriter)
+	if !ok {
+		return ErrCloseWriteUnsupported
+	}
+	return cw.CloseWrite()
+}
@@ -0,0 +1,50 @@
+/*
+   Copyright 2018 Docker, Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package httpnpipe
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestCloseWriteUnsupportedClosesBody(t *testing.T) {
+	pipes := &fakePipes{}
+	transport := &Transport{}
+	defer transport.Close()
+	if err := transport.RegisterTargetDialer("svc", pipes.dial); err != nil {
+		t.Fatal(err)
+	}
+	body := &trackedBody{Reader: strings.NewReader("body")}
+	req, _ := http.NewRequestWithContext(WithCloseWrite(context.Background()), http.MethodPost, "http+npipe://svc/", body)
+	resp, err := transport.RoundTrip(req)
+	if err == nil {
+		resp.Body.Close()
+		t.Fatal("RoundTrip succeeded over a connection without CloseWrite")
+	}
+	if !errors.Is(err, ErrCloseWriteUnsupported) {
+		t.Fatalf("got %v, want %v", err, ErrCloseWriteUnsupported)
+	}
+	if !body.closed.Load() {
+		t.Error("request body left open")
+	}
+	if n := pipes.leaked(); n != 0 {
+		t.Errorf("%d connections left open", n)
+	}
+}
@@ -0,0 +1,109 @@
+/*
+   Copyright 2018 Docker, Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package httpnpipe
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// requestGzip reports whether the transport should ask for a compressed
+// response to req on the caller's behalf. As with net/http.Transport, it
+// does not when the caller picked an encoding itself or asked for a Range,
+// since the range would apply to the compressed bytes.
+func (transport *Transport) requestGzip(req *http.Request) bool {
+	return !transport.DisableCompression &&
+		req.Method != http.MethodHead &&
+		req.Header.Get("Accept-Encoding") == "" &&
+		req.Header.Get("Range") == ""
+}
+
+// acceptEncoding returns the Accept-Encoding header the transport asks for
+// compression with: the content codings of Decoders, and gzip.
+func (transport *Transport) acceptEncoding() string {
+	if len(transport.Decoders) == 0 {
+		return "gzip"
+	}
+	codings := make([]string, 0, len(transport.Decoders)+1)
+	for coding := range transport.Decoders {
+		if !strings.EqualFold(coding, "gzip") {
+			codings = append(codings, strings.ToLower(coding))
+		}
+	}
+	sort.Strings(codings)
+	return strings.Join(append(codings, "gzip"), ", ")
+}
+
+// decoder returns the decoder for coding, one of those asked for by
+// acceptEncoding, or nil if it is not one of them.
+func (transport *Transport) decoder(coding string) func(io.Reader) (io.ReadCloser, error) {
+	for name, decode := range transport.Decoders {
+		if strings.EqualFold(name, coding) {
+			return decode
+		}
+	}
+	if strings.EqualFold(coding, "gzip") {
+		return func(r io.Reader) (io.ReadCloser, error) {
+			return gzip.NewReader(r)
+		}
+	}
+	return nil
+}
+
+// decompress replaces the body of a compressed resp with its decompressed
+// form, and drops the headers that described the compressed one. Bodies
+// with more than one coding applied are left as they are.
+func (transport *Transport) decompress(resp *http.Response) {
+	decode := transport.decoder(strings.TrimSpace(resp.Header.Get("Content-Encoding")))
+	if decode == nil || len(resp.Header.Values("Content-Encoding")) > 1 {
+		return
+	}
+	resp.Body = &decodingReader{body: resp.Body, decode: decode}
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Del("Content-Length")
+	resp.ContentLength = -1
+	resp.Uncompressed = true
+}
+
+// decodingReader decodes body, setting up the decoder on first Read so
+// that a body which is only ever closed costs nothing.
+type decodingReader struct {
+	body   io.ReadCloser
+	decode func(io.Reader) (io.ReadCloser, error)
+	r      io.ReadCloser
+	err    error
+}
+
+func (d *decodingReader) Read(p []byte) (int, error) {
+	if d.r == nil && d.err == nil {
+		d.r, d.err = d.decode(d.body)
+	}
+	if d.err != nil {
+		return 0, d.err
+	}
+	return d.r.Read(p)
+}
+
+func (d *decodingReader) Close() error {
+	if d.r != nil {
+		d.r.Close()
+	}
+	return d.body.Close()
+}
@@ -0,0 +1,135 @@
+/*
+   Copyright 2018 Docker, Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package httpnpipe
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Config is the declarative form of a Transport's service mappings, kept
+// in a JSON file such as:
+//
+//	{
+//		"services": {
+//			"engine": "\\\\.\\pipe\\docker_engine"
+//		},
+//		"defaultPipe": "\\\\.\\pipe\\fallback"
+//	}
+//
+// so that pipe names can be changed without recompiling clients.
+type Config struct {
+	// Services maps service names to pipe names.
+	Services map[string]string `json:"services"`
+	// DefaultPipe, if set, is passed to Transport.SetDefaultPipe.
+	DefaultPipe string `json:"defaultPipe,omitempty"`
+}
+
+// ReadConfig reads a Config from the JSON file at path.
+func ReadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var config Config
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("http+npipe: parsing %s: %w", path, err)
+	}
+	for service, pipeName := range config.Services {
+		if service == "" || pipeName == "" {
+			return nil, fmt.Errorf("http+npipe: %s: empty service or pipe name", path)
+		}
+	}
+	return &config, nil
+}
+
+// LoadServices registers the services listed in the config file at path,
+// as RegisterTargetServiceErr does. It fails without registering anything
+// if the file cannot be read or names a service that is already
+// registered.
+func (transport *Transport) LoadServices(path string) error {
+	return transport.Registry().LoadServices(path)
+}
+
+// LoadServices registers the services listed in the config file at path,
+// as Register does, all or nothing.
+func (reg *Registry) LoadServices(path string) error {
+	config, err := ReadConfig(path)
+	if err != nil {
+		return err
+	}
+	return reg.loadConfig(config)
+}
+
+func (reg *Registry) loadConfig(config *Config) error {
+	reg.mutex.Lock()
+	defer reg.unlockAndNotify()
+	r := reg.currentLocked()
+	for service := range config.Services {
+		if r.registered(service) {
+			return fmt.Errorf("%w: %q", ErrServiceRegistered, service)
+		}
+	}
+	for service, pipeName := range config.Services {
+		reg.setPipeLocked(service, pipeName)
+	}
+	if config.DefaultPipe != "" {
+		reg.setDefaultPipeLocked(config.DefaultPipe)
+	}
+	return nil
+}
+
+// NewTransportFromConfig returns a Transport with the services listed in
+// the config file at path registered, and default settings otherwise.
+func NewTransportFromConfig(path string) (*Transport, error) {
+	transport := &Transport{}
+	if err := transport.LoadServices(path); err != nil {
+		return nil, err
+	}
+	return transport, nil
+}
+
+// EnvServicePrefix starts the names of the environment variables read by
+// RegisterFromEnv.
+const EnvServicePrefix = "HTTPNPIPE_SERVICE_"
+
+// RegisterFromEnv maps services to pipes as given by environment variables
+// of the form
+//
+//	HTTPNPIPE_SERVICE_<NAME>=<pipe>
+//
+// replacing any mapping already registered for the service, so that the
+// environment can redirect services without code changes. NAME is taken
+// as the service name in lower case and with underscores turned into
+// hyphens: HTTPNPIPE_SERVICE_DOCKER_ENGINE sets service docker-engine.
+// Variables with an empty value are ignored.
+func (transport *Transport) RegisterFromEnv() {
+	for _, kv := range os.Environ() {
+		name, pipeName, ok := strings.Cut(kv, "=")
+		if !ok || pipeName == "" || !strings.HasPrefix(name, EnvServicePrefix) {
+			continue
+		}
+		service := strings.TrimPrefix(name, EnvServicePrefix)
+		if service == "" {
+			continue
+		}
+		service = strings.ReplaceAll(strings.ToLower(service), "_", "-")
+		transport.ReplaceTargetService(service, pipeName)
+	}
+}
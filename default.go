@@ -0,0 +1,38 @@
+/*
+   Copyright 2018 Docker, Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package httpnpipe
+
+import "net/http"
+
+// DefaultTransport is the Transport used by the package-level functions,
+// in the manner of net/http.DefaultTransport.
+var DefaultTransport = &Transport{}
+
+// DefaultClient is an http.Client using DefaultTransport, for use with
+// http+npipe URLs.
+var DefaultClient = &http.Client{Transport: DefaultTransport}
+
+// Register maps serviceName to pipeName for DefaultTransport, as
+// Transport.RegisterTargetServiceErr does.
+func Register(serviceName string, pipeName string) error {
+	return DefaultTransport.RegisterTargetServiceErr(serviceName, pipeName)
+}
+
+// Get issues a GET to url with DefaultClient.
+func Get(url string) (*http.Response, error) {
+	return DefaultClient.Get(url)
+}
@@ -0,0 +1,62 @@
+/*
+   Copyright 2018 Docker, Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package httpnpipe
+
+import (
+	"context"
+	"net"
+)
+
+// DialService connects to the pipe of serviceName, found as for a request
+// to it, and returns the connection as it is, for protocols other than
+// HTTP to run over, such as custom framing or ssh. DialTimeout applies,
+// but none of the pooling does; the connection is the caller's to close.
+func (transport *Transport) DialService(ctx context.Context, serviceName string) (net.Conn, error) {
+	service, pipeName, err := transport.lookupService(ctx, serviceName)
+	if err != nil {
+		return nil, err
+	}
+	return transport.dialRaw(ctx, service, pipeName)
+}
+
+// lookupService finds the service serviceName stands for and its pipe, as
+// for a request to it, to dial outside of the pool.
+func (transport *Transport) lookupService(ctx context.Context, serviceName string) (service, pipeName string, err error) {
+	transport.mutex.Lock()
+	closed := transport.closed
+	transport.mutex.Unlock()
+	if closed {
+		return "", "", ErrTransportClosed
+	}
+	if serviceName == "" {
+		return "", "", ErrNoHost
+	}
+	service = transport.routes().canonical(serviceName)
+	pipeName, err = transport.resolve(ctx, service)
+	if err != nil {
+		return "", "", err
+	}
+	return service, pipeName, nil
+}
+
+// DialContext is DialService under the signature grpc.WithContextDialer
+// wants, which passes the address of the target: gRPC clients dialing
+// "passthrough:///service" reach the same services, with the same
+// configuration, as HTTP clients.
+func (transport *Transport) DialContext(ctx context.Context, serviceName string) (net.Conn, error) {
+	return transport.DialService(ctx, serviceName)
+}
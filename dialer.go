@@ -0,0 +1,74 @@
+/*
+   Copyright 2018 Docker, Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package httpnpipe
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+)
+
+// serviceDialer is a dial function registered for a service in place of a
+// pipe. Its name stands in for the pipe name, so that connections from a
+// dialer that has since been replaced are not reused.
+type serviceDialer struct {
+	name string
+	dial func(ctx context.Context) (net.Conn, error)
+}
+
+// RegisterTargetDialer registers serviceName like RegisterTargetServiceErr,
+// but with dial in place of a pipe: connections to the service are made by
+// calling dial, which can return any stream connection, such as a pipe
+// opened while impersonating a user, a relayed connection, or one end of
+// net.Pipe in tests. dial is given the request's context, bounded by
+// DialTimeout.
+//
+// Connections from dial are pooled like those to pipes. LookupService
+// reports a description of the dialer in place of a pipe name.
+func (transport *Transport) RegisterTargetDialer(serviceName string, dial func(ctx context.Context) (net.Conn, error)) error {
+	return transport.Registry().RegisterDialer(serviceName, dial)
+}
+
+// RegisterDialer is like Register, but with dial in place of a pipe, as
+// described for Transport.RegisterTargetDialer.
+func (reg *Registry) RegisterDialer(serviceName string, dial func(ctx context.Context) (net.Conn, error)) error {
+	reg.mutex.Lock()
+	defer reg.unlockAndNotify()
+	if reg.currentLocked().registered(serviceName) {
+		return fmt.Errorf("%w: %q", ErrServiceRegistered, serviceName)
+	}
+	reg.dialerSeq++
+	d := &serviceDialer{
+		name: fmt.Sprintf("dialer #%d", reg.dialerSeq),
+		dial: dial,
+	}
+	reg.updateLocked(func(r *routes) {
+		r.dialers[serviceName] = d
+	})
+	return nil
+}
+
+// dialService connects to d, giving up after timeout if it is positive.
+func dialService(ctx context.Context, d *serviceDialer, timeout time.Duration) (net.Conn, error) {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	return d.dial(ctx)
+}
@@ -0,0 +1,74 @@
+/*
+   Copyright 2018 Docker, Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package httpnpipe
+
+import (
+	"os"
+	"sort"
+	"strings"
+)
+
+// PipeDir is the directory through which Windows lists the named pipes of
+// the local machine.
+const PipeDir = `\\.\pipe\`
+
+// ListPipes returns the paths of the existing named pipes whose names start
+// with prefix, in sorted order. It fails on systems without named pipes.
+func ListPipes(prefix string) ([]string, error) {
+	entries, err := os.ReadDir(PipeDir)
+	if err != nil {
+		return nil, err
+	}
+	var pipes []string
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), prefix) {
+			pipes = append(pipes, PipeDir+entry.Name())
+		}
+	}
+	sort.Strings(pipes)
+	return pipes, nil
+}
+
+// DiscoverServices registers a service for each existing named pipe whose
+// name starts with prefix, named after the rest of the pipe name, so
+// \\.\pipe\myapp-worker becomes the service "worker" for the prefix
+// "myapp-". Services that are already registered are left alone. It returns
+// the services it registered.
+func (transport *Transport) DiscoverServices(prefix string) ([]string, error) {
+	return transport.Registry().DiscoverServices(prefix)
+}
+
+// DiscoverServices registers services for the named pipes starting with
+// prefix, as described for Transport.DiscoverServices.
+func (reg *Registry) DiscoverServices(prefix string) ([]string, error) {
+	pipes, err := ListPipes(prefix)
+	if err != nil {
+		return nil, err
+	}
+	reg.mutex.Lock()
+	defer reg.unlockAndNotify()
+	var services []string
+	for _, pipe := range pipes {
+		service := strings.TrimPrefix(pipe, PipeDir+prefix)
+		if service == "" || reg.currentLocked().registered(service) {
+			continue
+		}
+		reg.setPipeLocked(service, pipe)
+		services = append(services, service)
+	}
+	return services, nil
+}
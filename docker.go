@@ -0,0 +1,71 @@
+/*
+   Copyright 2018 Docker, Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package httpnpipe
+
+import (
+	"context"
+	"net"
+	"net/http"
+)
+
+const (
+	// DockerEngineService is the service RegisterDockerEngine registers.
+	DockerEngineService = "docker"
+	// DockerEnginePipe is the pipe the Docker Engine listens on by default.
+	DockerEnginePipe = "//./pipe/docker_engine"
+	// DockerEngineSocket is the socket the Docker Engine listens on by
+	// default outside Windows.
+	DockerEngineSocket = "/var/run/docker.sock"
+)
+
+// RegisterDockerEngine maps DockerEngineService to DockerEnginePipe on
+// Windows and to DockerEngineSocket elsewhere, so that http+local://docker/
+// reaches a local Docker Engine on either. Any earlier mapping of the
+// service is replaced.
+func (transport *Transport) RegisterDockerEngine() {
+	transport.ReplaceTargetService(DockerEngineService, LocalEndpoint(DockerEnginePipe, DockerEngineSocket))
+}
+
+// DockerClient returns what the Engine API client of
+// github.com/docker/docker/client needs to reach serviceName through the
+// Transport: an *http.Client for client.WithHTTPClient, and the host for
+// client.WithHost, which must come first as it reconfigures the client's
+// transport otherwise:
+//
+//	httpClient, host := transport.DockerClient(httpnpipe.DockerEngineService)
+//	cli, err := client.NewClientWithOpts(
+//		client.WithHost(host),
+//		client.WithHTTPClient(httpClient),
+//		client.WithAPIVersionNegotiation(),
+//	)
+//
+// The API client sends plain http requests to host, and dials it itself
+// for attach and exec; either way the connection goes to serviceName as
+// the Transport has it mapped, to a pipe, a socket or a dialer, set up as
+// for the Transport's own requests. The connections are pooled by the
+// returned client, though, so the Transport's limits and hooks do not
+// apply to them. serviceName need not be registered yet.
+func (transport *Transport) DockerClient(serviceName string) (*http.Client, string) {
+	dial := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		service, pipeName, err := transport.lookupService(ctx, serviceName)
+		if err != nil {
+			return nil, err
+		}
+		return transport.dialWrapped(ctx, service, pipeName, protocolHTTP1)
+	}
+	return &http.Client{Transport: &http.Transport{DialContext: dial}}, "tcp://" + serviceName
+}
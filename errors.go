@@ -0,0 +1,80 @@
+/*
+   Copyright 2018 Docker, Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package httpnpipe
+
+import (
+	"errors"
+	"net"
+)
+
+// ErrServiceRegistered is returned by Transport.RegisterTargetServiceErr
+// for a service that is already registered.
+var ErrServiceRegistered = errors.New("http+npipe: service already registered")
+
+// ErrPipesUnsupported is returned by ListenPipe on systems without named
+// pipes.
+var ErrPipesUnsupported = errors.New("http+npipe: named pipes are not supported on this system")
+
+// Errors returned by Transport.RoundTrip. They are wrapped with details
+// about the request, so test for them with errors.Is.
+var (
+	ErrNilURL                 = errors.New("http+npipe: nil Request.URL")
+	ErrInvalidRequest         = errors.New("http+npipe: invalid request")
+	ErrUnsupportedScheme      = errors.New("http+npipe: unsupported protocol scheme")
+	ErrNoHost                 = errors.New("http+npipe: no Host in request URL")
+	ErrNoPipePath             = errors.New("http+npipe: no pipe in request URL path")
+	ErrUnknownService         = errors.New("http+npipe: unknown service")
+	ErrInvalidPipeName        = errors.New("http+npipe: invalid pipe name")
+	ErrRemotePipeDenied       = errors.New("http+npipe: remote pipes not allowed")
+	ErrRemoteLogon            = errors.New("http+npipe: logon for remote pipe failed")
+	ErrTransportClosed        = errors.New("http+npipe: transport closed")
+	ErrCloseWriteUnsupported  = errors.New("http+npipe: connection does not support CloseWrite")
+	ErrMalformedResponse      = errors.New("http+npipe: malformed response")
+	ErrResponseHeaderTooLarge = errors.New("http+npipe: server response headers exceeded MaxResponseHeaderBytes")
+	ErrClientNotAllowed       = errors.New("http+npipe: client not allowed")
+	ErrServerHandedOver       = errors.New("http+npipe: server handed its pipes over")
+	ErrServiceNotReady        = errors.New("http+npipe: service not ready")
+	ErrTunnelRefused          = errors.New("http+npipe: tunnel refused")
+	ErrStreamUnresponsive     = errors.New("http+npipe: server stopped answering keep-alive checks")
+	ErrAuthFailed             = errors.New("http+npipe: authentication handshake failed")
+	ErrNoProtocol             = errors.New("http+npipe: no protocol agreed on")
+	ErrContentLengthMismatch  = errors.New("http+npipe: response body length differs from what the response declared")
+)
+
+// DialError is returned when the named pipe behind a service cannot be
+// connected to. Err is the underlying cause, which errors.Is and errors.As
+// see through: for instance os.ErrNotExist when there is no such pipe, or
+// the context error when the request was cancelled while dialing.
+type DialError struct {
+	Service string
+	Pipe    string
+	Err     error
+}
+
+func (e *DialError) Error() string {
+	return "http+npipe: dial " + e.Service + " (" + e.Pipe + "): " + e.Err.Error()
+}
+
+func (e *DialError) Unwrap() error {
+	return e.Err
+}
+
+// Timeout reports whether the dial gave up for lack of time.
+func (e *DialError) Timeout() bool {
+	var ne net.Error
+	return errors.As(e.Err, &ne) && ne.Timeout()
+}
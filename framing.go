@@ -0,0 +1,81 @@
+/*
+   Copyright 2018 Docker, Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package httpnpipe
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+)
+
+// maxFrameSize bounds the messages read from a service registered
+// WithMessageFraming.
+const maxFrameSize = 64 << 20
+
+// WithMessageFraming makes a service's pipe carry HTTP in discrete
+// messages, for services that only speak message-mode pipes. Each message
+// is a frame: a 4-byte big-endian length, then that many bytes. A request
+// goes out whole in one frame, written after it is complete, so
+// ExpectContinueTimeout does not apply to it; the response may come in any
+// number of frames, which are read one after another.
+func WithMessageFraming() RegisterOption {
+	return func(r *registration) {
+		r.framed = true
+	}
+}
+
+// framedConn speaks the messages of WithMessageFraming over a pipe
+// connection: every write goes out as one frame, and reads return the
+// contents of the frames that come in, in order.
+type framedConn struct {
+	net.Conn
+	remaining uint32 // still to read of the current frame
+}
+
+func (c *framedConn) Read(p []byte) (int, error) {
+	for c.remaining == 0 {
+		var header [4]byte
+		if _, err := io.ReadFull(c.Conn, header[:]); err != nil {
+			if err == io.ErrUnexpectedEOF {
+				err = fmt.Errorf("%w: message frame cut short", ErrMalformedResponse)
+			}
+			return 0, err
+		}
+		c.remaining = binary.BigEndian.Uint32(header[:])
+		if c.remaining > maxFrameSize {
+			return 0, fmt.Errorf("%w: message frame of %d bytes", ErrMalformedResponse, c.remaining)
+		}
+	}
+	if uint32(len(p)) > c.remaining {
+		p = p[:c.remaining]
+	}
+	n, err := c.Conn.Read(p)
+	c.remaining -= uint32(n)
+	if err == io.EOF && c.remaining > 0 {
+		err = fmt.Errorf("%w: message frame cut short", ErrMalformedResponse)
+	}
+	return n, err
+}
+
+func (c *framedConn) Write(p []byte) (int, error) {
+	frame := make([]byte, 4+len(p))
+	binary.BigEndian.PutUint32(frame, uint32(len(p)))
+	copy(frame[4:], p)
+	n, err := c.Conn.Write(frame)
+	return max(n-4, 0), err
+}
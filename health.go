@@ -0,0 +1,96 @@
+/*
+   Copyright 2018 Docker, Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package httpnpipe
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// The paths a Server with HealthEndpoints set answers health probes on.
+const (
+	// HealthPath answers 200 OK for as long as the Server serves.
+	HealthPath = "/healthz"
+	// ReadyPath answers 200 OK when the Server is ready for requests, and
+	// 503 Service Unavailable, with the reason in the body, when not.
+	ReadyPath = "/readyz"
+)
+
+// healthHandler answers the health probes to srv and passes the other
+// requests on to handler.
+func (srv *Server) healthHandler(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		switch r.URL.Path {
+		case HealthPath:
+		case ReadyPath:
+			if err := srv.ready(); err != nil {
+				http.Error(w, err.Error(), http.StatusServiceUnavailable)
+				return
+			}
+		default:
+			handler.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		io.WriteString(w, "ok\n")
+	})
+}
+
+// ready reports why srv is not ready for requests, if it is not.
+func (srv *Server) ready() error {
+	select {
+	case <-srv.shutdownDone():
+		return errors.New("shutting down")
+	default:
+	}
+	if srv.Readiness != nil {
+		return srv.Readiness()
+	}
+	return nil
+}
+
+// ProbeService checks that serviceName is ready for requests by asking its
+// server for ReadyPath, as served by a Server with HealthEndpoints set. It
+// returns nil if the server answers 200 OK, and otherwise an error that
+// wraps ErrServiceNotReady, or the error the request failed with.
+func (transport *Transport) ProbeService(ctx context.Context, serviceName string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, Scheme+"://"+serviceName+ReadyPath, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		return nil
+	}
+	reason, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	if msg := strings.TrimSpace(string(reason)); msg != "" {
+		return fmt.Errorf("%w: %s: %s: %s", ErrServiceNotReady, serviceName, resp.Status, msg)
+	}
+	return fmt.Errorf("%w: %s: %s", ErrServiceNotReady, serviceName, resp.Status)
+}
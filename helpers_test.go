@@ -0,0 +1,154 @@
+/*
+   Copyright 2018 Docker, Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package httpnpipe
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakePipes dials connections for RegisterTargetDialer whose far ends are
+// served by serve over net.Pipe, counting the connections dialed and
+// closed. failWrite and failRead, if set, are returned by every Write or
+// Read on the client side of a connection in place of its data.
+type fakePipes struct {
+	serve     func(c net.Conn)
+	failWrite error
+	failRead  error
+
+	dialed atomic.Int32
+	closed atomic.Int32
+}
+
+func (p *fakePipes) dial(ctx context.Context) (net.Conn, error) {
+	client, server := net.Pipe()
+	p.dialed.Add(1)
+	go func() {
+		defer server.Close()
+		if p.serve != nil {
+			p.serve(server)
+		}
+	}()
+	return &fakeConn{Conn: client, pipes: p}, nil
+}
+
+// leaked returns how many of the connections dialed are not closed.
+func (p *fakePipes) leaked() int32 {
+	return p.dialed.Load() - p.closed.Load()
+}
+
+type fakeConn struct {
+	net.Conn
+	pipes *fakePipes
+	once  sync.Once
+}
+
+func (c *fakeConn) Read(b []byte) (int, error) {
+	if c.pipes.failRead != nil {
+		return 0, c.pipes.failRead
+	}
+	return c.Conn.Read(b)
+}
+
+func (c *fakeConn) Write(b []byte) (int, error) {
+	if c.pipes.failWrite != nil {
+		return 0, c.pipes.failWrite
+	}
+	return c.Conn.Write(b)
+}
+
+func (c *fakeConn) Close() error {
+	c.once.Do(func() { c.pipes.closed.Add(1) })
+	return c.Conn.Close()
+}
+
+// testServer is an HTTP server on a Unix domain socket that counts the
+// connections it has open.
+type testServer struct {
+	path string
+	open atomic.Int32
+}
+
+func startTestServer(t *testing.T, handler http.HandlerFunc) *testServer {
+	t.Helper()
+	s := &testServer{path: filepath.Join(t.TempDir(), "http.sock")}
+	l, err := net.Listen("unix", s.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{
+		Handler: handler,
+		ConnState: func(c net.Conn, state http.ConnState) {
+			switch state {
+			case http.StateNew:
+				s.open.Add(1)
+			case http.StateClosed, http.StateHijacked:
+				s.open.Add(-1)
+			}
+		},
+	}
+	go srv.Serve(l)
+	t.Cleanup(func() { srv.Close() })
+	return s
+}
+
+// waitFor fails the test unless cond becomes true within a few seconds.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); !cond(); {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// getBody sends a GET request for url with client and returns the body.
+func getBody(client *http.Client, url string) (string, error) {
+	resp, err := client.Get(url)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	return string(body), err
+}
+
+// idleConns returns how many connections to service transport has idle.
+func idleConns(transport *Transport, service string) int {
+	transport.mutex.Lock()
+	defer transport.mutex.Unlock()
+	return len(transport.idleConns[service])
+}
+
+// trackedBody is a request body that records whether it was closed.
+type trackedBody struct {
+	io.Reader
+	closed atomic.Bool
+}
+
+func (b *trackedBody) Close() error {
+	b.closed.Store(true)
+	return nil
+}
@@ -0,0 +1,131 @@
+/*
+   Copyright 2018 Docker, Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package httpnpipe
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"net/http"
+	"time"
+)
+
+// ResponseInfo describes how a Server answered a request, for its
+// OnResponse hook.
+type ResponseInfo struct {
+	// StatusCode is the status sent, or 200 if the handler wrote a body
+	// without one, or 0 if it sent nothing or hijacked the connection.
+	StatusCode int
+	// Bytes is the size of the body written.
+	Bytes int64
+	// Latency is the time from the handler being called to it returning.
+	Latency time.Duration
+	// Client is the identity of the client, if known.
+	Client ClientIdentity
+}
+
+// connContext sets up the context of each connection the Server accepts.
+func (srv *Server) connContext(ctx context.Context, c net.Conn) context.Context {
+	ctx = withClientIdentity(ctx, c)
+	if srv.OnAccept != nil {
+		id, _ := ClientIdentityFromContext(ctx)
+		srv.OnAccept(c, id)
+	}
+	if srv.ConnContext != nil {
+		ctx = srv.ConnContext(ctx, c)
+	}
+	return ctx
+}
+
+// hookHandler calls the request hooks of srv around handler.
+func (srv *Server) hookHandler(handler http.Handler) http.Handler {
+	if handler == nil {
+		handler = http.DefaultServeMux
+	}
+	if srv.OnRequest == nil && srv.OnResponse == nil {
+		return handler
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if srv.OnRequest != nil {
+			srv.OnRequest(r)
+		}
+		if srv.OnResponse == nil {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		rec := &responseRecorder{ResponseWriter: w}
+		start := time.Now()
+		defer func() {
+			info := ResponseInfo{
+				StatusCode: rec.status,
+				Bytes:      rec.bytes,
+				Latency:    time.Since(start),
+			}
+			info.Client, _ = ClientIdentityFromContext(r.Context())
+			srv.OnResponse(r, info)
+		}()
+		handler.ServeHTTP(rec, r)
+	})
+}
+
+// responseRecorder notes the status and body size of a response on its
+// way through.
+type responseRecorder struct {
+	http.ResponseWriter
+	status   int
+	bytes    int64
+	hijacked bool
+}
+
+func (rec *responseRecorder) WriteHeader(code int) {
+	if rec.status == 0 && code >= 200 {
+		rec.status = code
+	}
+	rec.ResponseWriter.WriteHeader(code)
+}
+
+func (rec *responseRecorder) Write(p []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	n, err := rec.ResponseWriter.Write(p)
+	rec.bytes += int64(n)
+	return n, err
+}
+
+// Flush and Hijack keep the features of the underlying ResponseWriter
+// available to handlers that check for them.
+
+func (rec *responseRecorder) Flush() {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	http.NewResponseController(rec.ResponseWriter).Flush()
+}
+
+func (rec *responseRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, rw, err := http.NewResponseController(rec.ResponseWriter).Hijack()
+	if err == nil {
+		rec.hijacked = true
+	}
+	return conn, rw, err
+}
+
+// Unwrap lets http.ResponseController reach the underlying ResponseWriter.
+func (rec *responseRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
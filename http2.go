@@ -0,0 +1,122 @@
+/*
+   Copyright 2018 Docker, Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package httpnpipe
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"strings"
+
+	"golang.org/x/net/http2"
+)
+
+// http2Transport returns the HTTP/2 transport requests go through under
+// EnableHTTP2 or NegotiateHTTP2, set up on first use.
+func (transport *Transport) http2Transport() *http2.Transport {
+	transport.mutex.Lock()
+	defer transport.mutex.Unlock()
+	if transport.h2 == nil {
+		transport.h2 = &http2.Transport{
+			AllowHTTP:          true,
+			DialTLSContext:     transport.dialHTTP2,
+			DisableCompression: transport.DisableCompression,
+			IdleConnTimeout:    transport.IdleConnTimeout,
+			ReadIdleTimeout:    max(transport.StreamKeepAlive, 0),
+			PingTimeout:        max(transport.StreamKeepAlive, 0),
+		}
+		if transport.MaxResponseHeaderBytes > 0 {
+			transport.h2.MaxHeaderListSize = uint32(min(transport.MaxResponseHeaderBytes, 1<<32-1))
+		}
+	}
+	return transport.h2
+}
+
+// roundTripHTTP2 sends req to service, on pipeName, over HTTP/2. The
+// connections are pooled by the HTTP/2 transport under an address made of
+// the service and pipe, which dialHTTP2 takes apart again, and of the port
+// of http or https, which tells it whether to run TLS.
+func (transport *Transport) roundTripHTTP2(req *http.Request, service, pipeName string) (*http.Response, error) {
+	transport.mutex.Lock()
+	closed := transport.closed
+	transport.mutex.Unlock()
+	if closed {
+		closeBody(req)
+		return nil, ErrTransportClosed
+	}
+	out := *req
+	u := *req.URL
+	u.Scheme = "http"
+	if req.URL.Scheme == SchemeTLS {
+		u.Scheme = "https"
+	}
+	u.Host = hex.EncodeToString([]byte(service)) + "." + hex.EncodeToString([]byte(pipeName))
+	out.URL = &u
+	if out.Host == "" {
+		out.Host = req.URL.Host
+	}
+	// The HTTP/2 transport only knows gzip; with Decoders, the transport
+	// asks for and decodes the codings itself.
+	r := transport.routes()
+	addedEncoding := len(transport.Decoders) > 0 && transport.requestGzip(req) &&
+		!isStreaming(req.Context()) && !r.streaming[service]
+	if addedEncoding {
+		out.Header = req.Header.Clone()
+		out.Header.Set("Accept-Encoding", transport.acceptEncoding())
+	}
+	resp, err := transport.http2Transport().RoundTrip(&out)
+	if err != nil {
+		return nil, err
+	}
+	resp.Request = req
+	if addedEncoding && resp.Body != http.NoBody {
+		transport.decompress(resp)
+	}
+	return resp, nil
+}
+
+// dialHTTP2 dials the pipe behind addr, as made by roundTripHTTP2.
+func (transport *Transport) dialHTTP2(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	encodedService, encodedPipe, _ := strings.Cut(host, ".")
+	service, err := hex.DecodeString(encodedService)
+	if err != nil {
+		return nil, err
+	}
+	pipeName, err := hex.DecodeString(encodedPipe)
+	if err != nil {
+		return nil, err
+	}
+	protocol := protocolH2C
+	if port == "443" {
+		protocol = protocolH2
+	}
+	c, err := transport.dialWrapped(ctx, string(service), string(pipeName), protocol)
+	if err != nil || port != "443" {
+		return c, err
+	}
+	tlsConn, err := transport.handshake(ctx, c, string(service), string(pipeName), http2.NextProtoTLS)
+	if err != nil {
+		return nil, err
+	}
+	return tlsConn, nil
+}
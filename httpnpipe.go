@@ -28,17 +28,45 @@ package httpnpipe
 
 import (
 	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
 	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
 	"net/http"
+	"net/http/httptrace"
+	"net/textproto"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/docker/go-connections/sockets"
+	"golang.org/x/net/http2"
 )
 
 // Scheme is the URL scheme used for HTTP over named pipes.
 const Scheme = "http+npipe"
 
+// SchemeTLS is the URL scheme used for HTTPS over named pipes: HTTP over
+// TLS over the pipe, set up by the Transport's TLSClientConfig.
+const SchemeTLS = "https+npipe"
+
+// SchemeUnix is the URL scheme used for HTTP over Unix domain sockets, for
+// client code that runs on Linux and macOS as well as Windows. Services
+// are registered and routed as for Scheme, mapped to the path of a socket
+// rather than to a pipe; a service mapped to a path that is not a pipe
+// name is reached over a Unix socket whatever the scheme.
+const SchemeUnix = "http+unix"
+
+// SchemeLocal is the URL scheme used for HTTP to services on this machine
+// over whichever of named pipes and Unix domain sockets the OS goes with,
+// as registered by RegisterLocalService, so that one code path reaches
+// both Docker Desktop on Windows and the engines of Linux and macOS.
+const SchemeLocal = "http+local"
+
 // Transport is a http.RoundTripper that connects to named pipes.
 
 type Transport struct {
@@ -46,70 +74,1018 @@ type Transport struct {
 	RequestTimeout        time.Duration
 	ResponseHeaderTimeout time.Duration
 
+	// HeaderWriteTimeout bounds each write of the request headers, and
+	// BodyWriteTimeout each write of the request body. Unlike
+	// RequestTimeout, which bounds writing the request as a whole, they
+	// let a slow upload go on for as long as it keeps making progress.
+	// Zero means no timeout.
+	HeaderWriteTimeout time.Duration
+	BodyWriteTimeout   time.Duration
+
+	// BodyReadTimeout bounds each read of the response body. Zero means no
+	// timeout, which suits long-lived streams such as event feeds;
+	// ResponseHeaderTimeout stops applying once the headers are in.
+	BodyReadTimeout time.Duration
+
+	// ExpectContinueTimeout, if non-zero, is how long to wait for the
+	// server's first response headers after writing the headers of a
+	// request with "Expect: 100-continue". The body is sent once the
+	// server answers 100 Continue, or once the timeout passes without an
+	// answer. Zero means the body is sent straight away.
+	ExpectContinueTimeout time.Duration
+
+	// DisableCompression, if true, stops the transport from asking for
+	// gzip with an "Accept-Encoding: gzip" header when the request has
+	// none. When the transport does ask, it also transparently
+	// decompresses the response and sets Response.Uncompressed.
+	DisableCompression bool
+
+	// Decoders adds content codings, such as zstd or br, to the gzip the
+	// transport asks for and decompresses, keyed by their name in
+	// Accept-Encoding. Each wraps a body in that coding in a reader of the
+	// decoded body. One for gzip stands in for the built-in decoder.
+	// DisableCompression turns them off along with gzip.
+	Decoders map[string]func(io.Reader) (io.ReadCloser, error)
+
+	// WriteProxyForm, if true, sends requests with the absolute
+	// http+npipe URL in the request line, as for a proxy, instead of just
+	// the path. This suits gateways that route on the full URL.
+	WriteProxyForm bool
+
+	// Resolver, if non-nil, maps service names to pipes in place of the
+	// services registered with RegisterTargetService.
+	Resolver Resolver
+
+	// OnUnknownService, if non-nil, is asked for the pipe of a service that
+	// is neither registered nor covered by a default pipe, before the
+	// request fails with ErrUnknownService. The pipe it returns is
+	// registered for the service, so it is only asked once per service,
+	// barring concurrent first requests. A non-nil error fails the request
+	// with that error; an empty pipe with a nil error leaves the service
+	// unknown. It is not used with a Resolver.
+	OnUnknownService func(service string) (pipeName string, err error)
+
+	// ValidateOnRegister, if true, makes RegisterTargetServiceErr check
+	// that the pipe can be connected to, so that a wrong pipe name is
+	// reported at once rather than on the first request.
+	// RegisterTargetService, which can only panic, does not check.
+	ValidateOnRegister bool
+
+	// DenyRemotePipes, if true, fails requests for services mapped to
+	// pipes on other machines, \\server\pipe\name, with
+	// ErrRemotePipeDenied.
+	DenyRemotePipes bool
+
+	// RemoteDialTimeout, if non-zero, bounds dialing a pipe on another
+	// machine in place of DialTimeout, covering the network connection to
+	// the machine as well as waiting for the pipe; negative means no
+	// timeout. Remote dials can take much longer than local ones.
+	RemoteDialTimeout time.Duration
+
+	// RemoteCredentials, if set, is called before each dial of a pipe on
+	// another machine with the service and the machine's host name, for
+	// the account to open the SMB session to it as: a username, a domain
+	// and a password, as for a net use. Returning nil credentials means
+	// the token the process runs as, as when RemoteCredentials is unset.
+	// If it fails, the request fails with its error in a *DialError.
+	// Pipes dialed through WSLRelay are not covered.
+	RemoteCredentials func(ctx context.Context, serviceName, host string) (*Credentials, error)
+
+	// AllowPipeURLs, if true, lets URLs with the host LocalPipeHost name a
+	// local pipe in their path, with no service registered for it.
+	AllowPipeURLs bool
+
+	// ServiceRewrite, if non-nil, picks the service a request is sent to,
+	// in place of the URL's host. Returning an empty service with a nil
+	// error leaves the request on URL.Host; a non-nil error fails the
+	// request with that error.
+	ServiceRewrite func(*http.Request) (service string, err error)
+
+	// StrictParsing, if true, rejects responses whose framing is open to
+	// more than one reading: header lines not ended by CRLF, folded header
+	// lines, repeated Content-Length headers, or Content-Length together
+	// with Transfer-Encoding. Malformed chunk sizes are rejected either
+	// way. This hardens clients talking to third-party pipe servers.
+	StrictParsing bool
+
+	// StrictContentLength, if true, checks that each response body is as
+	// long as its Content-Length, or its chunked framing, says. Reading a
+	// body that is cut short fails with an error wrapping
+	// ErrContentLengthMismatch, and so does reaching the end of one that
+	// more data follows, which would otherwise pass for the start of the
+	// response to the next request on the connection. Either way, the
+	// connection is closed rather than reused. Only more data that arrives
+	// along with the body can be caught.
+	StrictContentLength bool
+
+	// MaxResponseHeaderBytes limits how many bytes of response headers
+	// the server may send, counting those of any 1xx responses along with
+	// the final ones. If zero, a default of 10 MB is used.
+	MaxResponseHeaderBytes int64
+
+	// ReadBufferSize and WriteBufferSize size the buffers responses are
+	// read and requests written through, in bytes. Larger buffers mean
+	// fewer pipe operations for large payloads. Zero means 4 KB.
+	ReadBufferSize  int
+	WriteBufferSize int
+
+	// MaxIdleConnsPerService controls how many idle (keep-alive)
+	// connections are kept per service. If zero,
+	// DefaultMaxIdleConnsPerService is used; a negative value disables
+	// connection reuse.
+	MaxIdleConnsPerService int
+
+	// MaxConnsPerService, if positive, limits how many connections, idle
+	// or in use, are open to each service at once. Requests beyond that
+	// wait, for as long as their context allows, for a connection to be
+	// released. This suits servers with a fixed number of pipe instances.
+	MaxConnsPerService int
+
+	// IdleConnTimeout is how long an idle connection is kept before it is
+	// closed. Zero means no limit.
+	IdleConnTimeout time.Duration
+
+	// MaxConnLifetime is how long after it was dialed a connection may
+	// still be reused; older ones are closed rather than handed to another
+	// request, and closed while idle once they reach it. This keeps
+	// clients from holding on to connections to a server that has since
+	// been restarted. Zero means no limit.
+	MaxConnLifetime time.Duration
+
+	// Authenticator, if set, answers a 401 Unauthorized that asks for its
+	// scheme, such as Negotiate or NTLM (see SSPIAuthenticator), with the
+	// scheme's handshake, over the connection the 401 came on, for as
+	// many round trips as the scheme takes, and returns the response to
+	// the last of them. Such schemes authenticate the connection rather
+	// than the request, so the server has to keep it open in between; if
+	// it does not, the request fails with an error wrapping
+	// ErrAuthFailed. A 401 to a request whose body cannot be sent again,
+	// for want of GetBody, is returned as it came. Requests over HTTP/2
+	// are never authenticated this way.
+	Authenticator Authenticator
+
+	// StreamKeepAlive, if positive, is how often the server at the other
+	// end of a long-lived stream is checked on while the stream is open:
+	// the connection of an upgrade or a CONNECT, as for docker attach and
+	// exec, or a streaming response (see WithStreaming), as for docker
+	// events. Each check is an "OPTIONS *" request to the same pipe, over
+	// another connection, which the server must answer within
+	// StreamKeepAlive. A check is skipped when MaxConnsPerService leaves
+	// no connection for it. If the server does not answer, it is taken for
+	// hung or gone: the stream's connection is closed, and reading or
+	// writing it fails with an error wrapping ErrStreamUnresponsive rather
+	// than blocking forever. HTTP/2 connections are pinged instead.
+	StreamKeepAlive time.Duration
+
+	// ConnWrapper, if set, is called with each new connection to a
+	// service, straight after the pipe is dialed and before anything else
+	// goes over it, TLS included, for an application handshake such as a
+	// preamble, a version negotiation or an auth token. HTTP is spoken over
+	// the connection it returns, which may be c itself or wrap it. It runs
+	// within DialTimeout and the request context, set as a deadline on c.
+	// If it fails, c is closed, and the request fails with a *DialError.
+	// Connections from DialService are left as they are.
+	ConnWrapper func(c net.Conn, serviceName string) (net.Conn, error)
+
+	// WSLRelay, if set, is the Windows program through which pipes are
+	// dialed when the Transport runs inside WSL (see IsWSL), such as
+	// DefaultWSLRelay. It is started through WSL interop for each
+	// connection, as WSLRelay -ep -s <pipe> in the manner of npiperelay,
+	// and HTTP is spoken over its standard input and output, so that the
+	// same service mappings reach Windows-side daemons from Linux tools.
+	// Outside WSL it is ignored; Unix domain sockets are dialed directly
+	// either way.
+	WSLRelay string
+
+	// TLSClientConfig configures the TLS that https+npipe URLs are spoken
+	// over, such as the roots to trust and a client certificate for mTLS.
+	// If nil, the default configuration is used. An empty ServerName
+	// means the name of the service.
+	TLSClientConfig *tls.Config
+
+	// EnableHTTP2, if true, sends requests with HTTP/2 over the pipes, to
+	// servers known to speak it, such as a Server with EnableH2C set.
+	// Requests to a service are multiplexed over one pipe connection, in
+	// place of one connection for each request in flight. Over HTTP/2,
+	// DialTimeout is the only timeout that applies; the other HTTP/1.1
+	// settings, such as the timeouts and the connection limits, do not.
+	// Requests to upgrade the connection to another protocol, and CONNECT
+	// requests, still go over HTTP/1.1.
+	EnableHTTP2 bool
+
+	// NegotiateHTTP2, if true, sends requests to a pipe with HTTP/1.1 until
+	// the server there says, with HeaderMultiplex, that it speaks HTTP/2
+	// too, as a Server with EnableH2C does, and with HTTP/2 from then on.
+	// This multiplexes the requests to servers that can take it over one
+	// pipe connection, where pipe instances are scarce, and leaves the
+	// others be. A pipe whose HTTP/2 connection cannot be set up, as when
+	// its server is restarted without EnableH2C, and one no service is
+	// mapped to any more, goes back to HTTP/1.1 until it says so again.
+	NegotiateHTTP2 bool
+
 	mutex sync.Mutex
-	// map a URL "hostname" to a named pipe
-	pipeMapping map[string]string
+	// the Registry of service mappings, created on first use
+	registry atomic.Pointer[Registry]
+	// idle connections, keyed by service name
+	idleConns map[string][]*persistConn
+	// number of open connections, idle or not, and requests waiting for
+	// one under MaxConnsPerService, keyed by service name
+	conns       map[string]int
+	connWaiters map[string][]chan struct{}
+	closed      bool
+	// the HTTP/2 transport used when EnableHTTP2 or NegotiateHTTP2 is set,
+	// and the pipes found to speak HTTP/2 under NegotiateHTTP2
+	h2      *http2.Transport
+	h2Pipes map[string]bool
 }
 
 // RegisterTargetService registers a service name (URL) and maps it to target
-// named pipe.
+// named pipe, or to the path of a Unix domain socket (see SchemeUnix).
 // This function is invoked in the client wishing to connect to a given
 // service over named pipes.
 //
 // Calling RegisterTargetService twice for the same service is a
-// programmer error, and causes a panic.
-func (transport *Transport) RegisterTargetService(serviceName string, pipeName string) {
-	transport.mutex.Lock()
-	defer transport.mutex.Unlock()
-	if transport.pipeMapping == nil {
-		transport.pipeMapping = make(map[string]string)
-	}
-	if _, exists := transport.pipeMapping[serviceName]; exists {
+// programmer error, and causes a panic. Use RegisterTargetServiceErr where
+// that cannot be ruled out, and ReplaceTargetService to change a mapping
+// on purpose.
+//
+// Whether the pipe can be reached is not checked, even with
+// ValidateOnRegister, as a missing pipe is no programmer error; requests
+// to the service report it instead.
+//
+// Options such as WithLabels attach more to the registration.
+func (transport *Transport) RegisterTargetService(serviceName string, pipeName string, opts ...RegisterOption) {
+	if err := transport.Registry().Register(serviceName, pipeName, opts...); err != nil {
 		panic("service " + serviceName + " already registered")
 	}
-	transport.pipeMapping[serviceName] = pipeName
 }
 
-var _ http.RoundTripper = (*Transport)(nil)
+// RegisterTargetServiceErr is like RegisterTargetService, but returns an
+// error wrapping ErrServiceRegistered instead of panicking when serviceName
+// is already registered. With ValidateOnRegister, it also returns the
+// error of VerifyPipe for a pipe that cannot be reached.
+func (transport *Transport) RegisterTargetServiceErr(serviceName string, pipeName string, opts ...RegisterOption) error {
+	if transport.ValidateOnRegister {
+		if err := transport.VerifyPipe(context.Background(), serviceName, pipeName); err != nil {
+			return err
+		}
+	}
+	return transport.Registry().Register(serviceName, pipeName, opts...)
+}
+
+// AliasService makes alias another name for service: requests for either go
+// to the same pipe, and share pooled connections. service need not be
+// registered yet. It is an error, wrapping ErrServiceRegistered, for alias
+// to be registered already, as a service or an alias. It is an error too
+// for alias to be what other aliases stand for, as aliases do not chain.
+func (transport *Transport) AliasService(alias string, service string) error {
+	return transport.Registry().Alias(alias, service)
+}
+
+// ReplaceTargetService maps serviceName to pipeName whether or not it is
+// already registered. If the service was mapped to another pipe, its idle
+// connections are closed, and connections in use for requests to the old
+// pipe are closed once those requests are done. If serviceName was an
+// alias, it stops being one.
+func (transport *Transport) ReplaceTargetService(serviceName string, pipeName string) {
+	transport.Registry().Replace(serviceName, pipeName)
+}
+
+// UnregisterTargetService removes the mapping for serviceName, if there is
+// one. Idle connections to the service are closed; requests already under
+// way finish normally, but their connections are not kept afterwards.
+// Unregistering an alias removes just the alias.
+func (transport *Transport) UnregisterTargetService(serviceName string) {
+	transport.Registry().Unregister(serviceName)
+}
+
+// SetDefaultPipe makes pipeName the pipe for any service that has not been
+// registered, which suits deployments with a single server where the
+// service in the URL is only informational. An empty pipeName removes the
+// default again.
+func (transport *Transport) SetDefaultPipe(pipeName string) {
+	transport.Registry().SetDefaultPipe(pipeName)
+}
+
+// LookupService returns the pipe that requests for serviceName go to: the
+// one registered for it, or else the default pipe. It does not consult
+// the Resolver. For a service registered with RegisterTargetDialer, it
+// returns a description of the dialer instead.
+func (transport *Transport) LookupService(serviceName string) (pipeName string, ok bool) {
+	return transport.Registry().Lookup(serviceName)
+}
+
+// Services returns a copy of the registered mappings from service names to
+// pipes.
+func (transport *Transport) Services() map[string]string {
+	return transport.Registry().Services()
+}
+
+var (
+	_ http.RoundTripper = (*Transport)(nil)
+	_ io.Closer         = (*Transport)(nil)
+)
+
+// InstallInto registers the Transport with t for http+npipe, https+npipe,
+// http+unix and http+local URLs, so that a client using t serves them
+// alongside http and https ones. Like t.RegisterProtocol, it panics if t
+// already has a transport for any of those schemes.
+func (transport *Transport) InstallInto(t *http.Transport) {
+	t.RegisterProtocol(Scheme, transport)
+	t.RegisterProtocol(SchemeTLS, transport)
+	t.RegisterProtocol(SchemeUnix, transport)
+	t.RegisterProtocol(SchemeLocal, transport)
+}
 
 // RoundTrip executes a single HTTP transaction. See
 // net/http.RoundTripper.
 func (transport *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req, service, pipeName, err := transport.route(req)
+	if err != nil {
+		closeBody(req)
+		return nil, err
+	}
+
+	if transport.useHTTP2(pipeName) && !isUpgrade(req) && req.Method != http.MethodConnect {
+		resp, err := transport.roundTripHTTP2(req, service, pipeName)
+		if err == nil || !transport.forgetMultiplex(req, pipeName, err) || !isReplayable(req) {
+			return resp, err
+		}
+		// The server there no longer speaks HTTP/2, as after a restart
+		// without EnableH2C; try it again over HTTP/1.1.
+		if req, err = rewindBody(req); err != nil {
+			return nil, err
+		}
+	}
+
+	ctx := req.Context()
+	if r := transport.routes(); r.streaming[r.canonical(service)] {
+		ctx = WithStreaming(ctx)
+	}
+	secure := req.URL.Scheme == SchemeTLS
+	pc, err := transport.getConn(ctx, service, pipeName, secure, true)
+	if err != nil {
+		closeBody(req)
+		return nil, err
+	}
+	// A 401 may start a handshake over this very connection, so it does
+	// not go back to the pool until that is settled.
+	pc.hold = transport.Authenticator != nil
+	resp, err := transport.roundTrip(ctx, pc, req)
+
+	var stale *staleConnError
+	if errors.As(err, &stale) {
+		err = stale.err
+		if ctx.Err() == nil && isReplayable(req) {
+			// The pooled connection had been closed by the server while
+			// idle; give the request one more go on a fresh one.
+			if req, err = rewindBody(req); err != nil {
+				return nil, err
+			}
+			// The server may have gone away because the service moved;
+			// follow it if so.
+			if pipeName, err = transport.reresolve(ctx, service, pipeName); err != nil {
+				closeBody(req)
+				return nil, err
+			}
+			if pc, err = transport.getConn(ctx, service, pipeName, secure, false); err != nil {
+				closeBody(req)
+				return nil, err
+			}
+			pc.hold = transport.Authenticator != nil
+			resp, err = transport.roundTrip(ctx, pc, req)
+		}
+	}
+	if transport.Authenticator != nil {
+		if err == nil && resp.StatusCode == http.StatusUnauthorized {
+			resp, err = transport.authenticate(ctx, pc, req, resp)
+		}
+		transport.unholdConn(pc)
+	}
+	if err == nil {
+		transport.noteMultiplex(pc.pipeName, resp)
+	}
+	return resp, err
+}
+
+// route checks req and works out the service it is for and the pipe that
+// service is reached through. For a URL naming its pipe, it returns a
+// copy of req with that part of the path taken out.
+func (transport *Transport) route(req *http.Request) (_ *http.Request, service, pipeName string, err error) {
 	if req.URL == nil {
-		return nil, errors.New("http+npipe: nil Request.URL")
+		return req, "", "", ErrNilURL
+	}
+	switch req.URL.Scheme {
+	case Scheme, SchemeTLS, SchemeUnix, SchemeLocal:
+	default:
+		return req, "", "", fmt.Errorf("%w: %q", ErrUnsupportedScheme, req.URL.Scheme)
 	}
-	if req.URL.Scheme != Scheme {
-		return nil, errors.New("unsupported protocol scheme: " + req.URL.Scheme)
+	if err := validateRequest(req); err != nil {
+		return req, "", "", err
 	}
-	if req.URL.Host == "" {
-		return nil, errors.New("http+npipe: no Host in request URL")
+	if transport.AllowPipeURLs && req.URL.Host == LocalPipeHost {
+		out, pipeName, err := pipeURLRequest(req)
+		if err != nil {
+			return req, "", "", err
+		}
+		// The pipe name stands for the service, which keeps its pooled
+		// connections apart from those of registered services.
+		return out, pipeName, pipeName, nil
 	}
 
-	transport.mutex.Lock()
-	pipeName, ok := transport.pipeMapping[req.URL.Host]
-	transport.mutex.Unlock()
-	if !ok {
-		return nil, errors.New("unknown service: " + req.Host)
+	service = req.URL.Host
+	if transport.ServiceRewrite != nil {
+		rewritten, err := transport.ServiceRewrite(req)
+		if err != nil {
+			return req, "", "", err
+		}
+		if rewritten != "" {
+			service = rewritten
+		}
+	}
+	if service == "" {
+		return req, "", "", ErrNoHost
 	}
+	service = transport.routes().canonical(service)
 
-	c, err := sockets.DialPipe(pipeName, transport.DialTimeout)
+	pipeName, err = transport.resolve(req.Context(), service)
 	if err != nil {
+		return req, "", "", err
+	}
+	return req, service, pipeName, nil
+}
+
+// roundTrip sends req over pc and reads the response headers. The
+// connection is released once the caller is done with the response body.
+func (transport *Transport) roundTrip(ctx context.Context, pc *persistConn, req *http.Request) (_ *http.Response, err error) {
+	c := pc.conn
+	timeouts := transport.timeouts(ctx)
+
+	halfClose := wantsCloseWrite(ctx)
+	if _, ok := c.(closeWriter); halfClose && !ok {
+		closeBody(req)
+		pc.close()
+		return nil, ErrCloseWriteUnsupported
+	}
+
+	// Closing the connection unblocks any pending write or read once the
+	// request context is done.
+	stop := context.AfterFunc(ctx, pc.close)
+
+	// A connection that failed partway through a request is in no state to
+	// carry another one.
+	defer func() {
+		if err != nil {
+			pc.close()
+		}
+	}()
+
+	wreq := req
+	if transport.maxIdleConnsPerService() < 0 && !req.Close && !isUpgrade(req) && !pc.hold {
+		// The connection will not be reused, so let the server know.
+		// Upgrades are left alone, as "Connection: close" would spoil
+		// them; their connections are never reused anyway. Nor are
+		// requests that may need an authentication handshake over the
+		// connection.
+		wreq = cloneRequest(wreq)
+		wreq.Close = true
+	}
+
+	streaming := isStreaming(ctx)
+	if streaming {
+		timeouts.BodyReadTimeout = 0
+	}
+
+	addedGzip := !streaming && transport.requestGzip(req)
+	if addedGzip {
+		wreq = cloneRequest(wreq)
+		wreq.Header = req.Header.Clone()
+		wreq.Header.Set("Accept-Encoding", transport.acceptEncoding())
+	}
+
+	early, err := transport.writeRequest(ctx, pc, wreq)
+	if err == nil && early == nil && halfClose {
+		err = closeWrite(c)
+	}
+
+	var resp *http.Response
+	bodySkipped := early != nil
+	switch {
+	case bodySkipped:
+		// The server answered before it got the body, which leaves the
+		// connection in the middle of the request.
+		resp = early
+	case err != nil:
+		return nil, pc.staleError(contextError(ctx, stop, err))
+	default:
+		if d := deadline(ctx, timeouts.ResponseHeaderTimeout); !d.IsZero() {
+			c.SetReadDeadline(d)
+		}
+		resp, err = transport.readResponse(pc, req, false)
+		if err == io.EOF {
+			err = pc.staleError(err)
+		}
+		if err != nil {
+			return nil, contextError(ctx, stop, err)
+		}
+	}
+	// ResponseHeaderTimeout is over with; only the request context
+	// still bounds reading the body.
+	c.SetReadDeadline(deadline(ctx, 0))
+	if tlsConn, ok := c.(*tls.Conn); ok {
+		state := tlsConn.ConnectionState()
+		resp.TLS = &state
+	}
+	if resp.StatusCode == http.StatusSwitchingProtocols && !bodySkipped {
+		if !isUpgrade(req) {
+			stop()
+			return nil, fmt.Errorf("%w: 101 Switching Protocols to a request for no upgrade", ErrMalformedResponse)
+		}
+		// The connection now carries the new protocol, in both directions.
+		resp.Body = &upgradedBody{pc: pc, stop: stop, watch: transport.watchStream(pc)}
+		return resp, nil
+	}
+	if isTunnel(req, resp) && !bodySkipped {
+		resp.Body = &upgradedBody{pc: pc, stop: stop, watch: transport.watchStream(pc)}
+		return resp, nil
+	}
+	// Responses to HEAD, 204 and 304 responses, and those with a
+	// Content-Length of 0 have no body, which http.ReadResponse marks so.
+	bodyless := resp.Body == http.NoBody
+	b := &body{
+		ReadCloser:  resp.Body,
+		ctx:         ctx,
+		stop:        stop,
+		conn:        c,
+		readTimeout: timeouts.BodyReadTimeout,
+		release: func(reusable bool) {
+			if reusable && !bodySkipped && !halfClose && keepAlive(wreq, resp) {
+				transport.putIdleConn(pc)
+			} else {
+				pc.close()
+			}
+		},
+	}
+	if transport.StrictContentLength {
+		b.br = pc.br
+	}
+	resp.Body = b
+	if bodyless {
+		// There is nothing for the caller to read, so the connection
+		// is released at once rather than once the body is closed.
+		b.finish(func() { b.release(b.stop() && !b.overran()) })
+		return resp, nil
+	}
+	if streaming {
+		watch, release := transport.watchStream(pc), b.release
+		b.watch = watch
+		b.release = func(reusable bool) {
+			watch.close()
+			release(reusable)
+		}
+	}
+	if addedGzip {
+		transport.decompress(resp)
+	}
+	return resp, nil
+}
+
+// cloneRequest returns a shallow copy of req, so that the fields the
+// transport adjusts for the wire do not leak back to the caller.
+func cloneRequest(req *http.Request) *http.Request {
+	r := new(http.Request)
+	*r = *req
+	return r
+}
+
+func expectsContinue(req *http.Request) bool {
+	return hasBody(req) && hasToken(req.Header, "Expect", "100-continue")
+}
+
+// writeRequest writes req to pc. If the server gives its final answer
+// before the body has been sent, as it may for "Expect: 100-continue",
+// writeRequest stops short and returns that response.
+func (transport *Transport) writeRequest(ctx context.Context, pc *persistConn, req *http.Request) (*http.Response, error) {
+	timeouts := transport.timeouts(ctx)
+	w := &deadlineWriter{
+		conn:    pc.conn,
+		ctx:     ctx,
+		overall: deadline(ctx, timeouts.RequestTimeout),
+		timeout: timeouts.HeaderWriteTimeout,
+	}
+	// req.Write writes straight through to an io.ByteWriter, so the
+	// buffering, and when to flush, is up to us: once after the headers
+	// when the body has to wait for them, before each read of an upload
+	// body, and once at the end.
+	bw := getBufioWriter(w, bufferSize(transport.WriteBufferSize))
+	defer putBufioWriter(bw)
+
+	if hasTrailers(req) && req.ContentLength > 0 {
+		// Trailers can only follow a chunked body, and req.Write drops
+		// them from a request of known length.
+		req = cloneRequest(req)
+		req.ContentLength = -1
+	}
+
+	if pc.framed {
+		// The request has to go in one message, so all of it is written
+		// out before any of it is sent.
+		var buf bytes.Buffer
+		err := transport.writeTo(&buf, req)
+		if err == nil {
+			_, err = w.Write(buf.Bytes())
+		}
 		return nil, err
 	}
 
-	r := bufio.NewReader(c)
-	if transport.RequestTimeout > 0 {
-		c.SetWriteDeadline(time.Now().Add(transport.RequestTimeout))
+	var early *http.Response
+	expectContinue := timeouts.ExpectContinueTimeout > 0 && expectsContinue(req)
+	upload, _ := req.Body.(*uploadBody)
+	var rb *requestBody
+	if hasBody(req) && (expectContinue || upload != nil || timeouts.HeaderWriteTimeout > 0 || timeouts.BodyWriteTimeout > 0) {
+		rb = &requestBody{
+			ReadCloser: req.Body,
+			onStart: func() error {
+				if err := bw.Flush(); err != nil {
+					return err
+				}
+				w.timeout = timeouts.BodyWriteTimeout
+				if !expectContinue {
+					return nil
+				}
+				resp, err := transport.awaitContinue(ctx, pc, req, timeouts)
+				if err == nil && resp != nil {
+					early, err = resp, errBodySkipped
+				}
+				return err
+			},
+		}
+		if upload != nil {
+			// What the upload wrote goes out before more is asked of it.
+			// The upload is closed here, below, with the reason the
+			// request ended, rather than by req.Write.
+			rb.ReadCloser = io.NopCloser(upload)
+			rb.beforeRead = bw.Flush
+		}
+		req = cloneRequest(req)
+		req.Body = rb
 	}
 
-	if err := req.Write(c); err != nil {
+	err := transport.writeTo(bw, req)
+	if err == nil {
+		err = bw.Flush()
+	}
+	if rb != nil && rb.readErr != nil {
+		// req.Write hides the error behind a type of its own.
+		err = rb.readErr
+	}
+	if upload != nil {
+		upload.closeWithError(err)
+	}
+	if early != nil {
+		return early, nil
+	}
+	return nil, err
+}
+
+// writeTo writes req to w in the form the Transport sends requests in.
+func (transport *Transport) writeTo(w io.Writer, req *http.Request) error {
+	if transport.WriteProxyForm && req.Method != http.MethodConnect {
+		return req.WriteProxy(w)
+	}
+	return req.Write(w)
+}
+
+var bufioWriterPool sync.Pool
+
+// defaultBufferSize is the size of the buffers of a Transport, unless
+// ReadBufferSize or WriteBufferSize say otherwise. Only writers of this
+// size are pooled.
+const defaultBufferSize = 4 << 10
+
+func bufferSize(size int) int {
+	if size > 0 {
+		return size
+	}
+	return defaultBufferSize
+}
+
+func getBufioWriter(w io.Writer, size int) *bufio.Writer {
+	if size != defaultBufferSize {
+		return bufio.NewWriterSize(w, size)
+	}
+	if bw, ok := bufioWriterPool.Get().(*bufio.Writer); ok {
+		bw.Reset(w)
+		return bw
+	}
+	return bufio.NewWriterSize(w, size)
+}
+
+func putBufioWriter(bw *bufio.Writer) {
+	if bw.Size() != defaultBufferSize {
+		return
+	}
+	bw.Reset(nil)
+	bufioWriterPool.Put(bw)
+}
+
+// deadlineWriter renews the connection's write deadline before every write,
+// so that timeout bounds each write rather than the request as a whole. The
+// deadline never goes past overall.
+type deadlineWriter struct {
+	conn    net.Conn
+	ctx     context.Context
+	overall time.Time
+	timeout time.Duration
+}
+
+func (w *deadlineWriter) Write(p []byte) (int, error) {
+	w.conn.SetWriteDeadline(earliest(w.overall, deadline(w.ctx, w.timeout)))
+	return w.conn.Write(p)
+}
+
+// requestBody wraps a request body to call onStart before the body is first
+// read, which is when req.Write is done with the headers, and beforeRead,
+// if set, before every read after that. An error from either ends the
+// write. An error from the body itself is kept in readErr.
+type requestBody struct {
+	io.ReadCloser
+	onStart    func() error
+	beforeRead func() error
+	once       sync.Once
+	err        error
+	readErr    error
+}
+
+func (b *requestBody) Read(p []byte) (int, error) {
+	first := false
+	b.once.Do(func() {
+		first = true
+		b.err = b.onStart()
+	})
+	if b.err == nil && !first && b.beforeRead != nil {
+		b.err = b.beforeRead()
+	}
+	if b.err != nil {
+		return 0, b.err
+	}
+	n, err := b.ReadCloser.Read(p)
+	if err != nil && err != io.EOF {
+		b.readErr = err
+	}
+	return n, err
+}
+
+func hasBody(req *http.Request) bool {
+	return req.Body != nil && req.Body != http.NoBody
+}
+
+// hasTrailers reports whether req declares trailers to send after its body.
+// Their values may only be filled in once the body has been read.
+func hasTrailers(req *http.Request) bool {
+	return hasBody(req) && len(req.Trailer) > 0
+}
+
+// awaitContinue waits up to ExpectContinueTimeout for the server to react to
+// the request headers. A nil response means the body should be sent; a
+// non-nil one is the server's final answer and the body must be held back.
+func (transport *Transport) awaitContinue(ctx context.Context, pc *persistConn, req *http.Request, timeouts Timeouts) (*http.Response, error) {
+	pc.conn.SetReadDeadline(deadline(ctx, timeouts.ExpectContinueTimeout))
+	if _, err := pc.br.Peek(1); err != nil {
+		if ne, ok := err.(net.Error); ok && ne.Timeout() && ctx.Err() == nil {
+			// The server is silent, send the body anyway.
+			pc.conn.SetReadDeadline(time.Time{})
+			return nil, nil
+		}
 		return nil, err
 	}
 
-	if transport.ResponseHeaderTimeout > 0 {
-		c.SetReadDeadline(time.Now().Add(transport.ResponseHeaderTimeout))
+	pc.conn.SetReadDeadline(deadline(ctx, timeouts.ResponseHeaderTimeout))
+	resp, err := transport.readResponse(pc, req, true)
+	if err != nil {
+		return nil, err
 	}
+	if resp.StatusCode == http.StatusContinue {
+		return nil, nil
+	}
+	return resp, nil
+}
 
-	resp, err := http.ReadResponse(r, req)
-	return resp, err
+// readResponse reads the response to req from pc, passing over any 1xx
+// informational responses that precede it, such as 103 Early Hints. Those
+// are reported to the request's httptrace.ClientTrace, if any, with their
+// own headers, which are kept apart from those of the final response. With
+// stopAtContinue, a 100 Continue is returned like a final response.
+//
+// 101 Switching Protocols is final: whatever follows it is no longer HTTP.
+func (transport *Transport) readResponse(pc *persistConn, req *http.Request, stopAtContinue bool) (*http.Response, error) {
+	trace := httptrace.ContextClientTrace(req.Context())
+	limit := transport.maxResponseHeaderBytes()
+	// The informational responses count against the limit together with
+	// the final one, so a server cannot keep sending them without end.
+	pc.setReadLimit(limit)
+	defer pc.setReadLimit(math.MaxInt64)
+	for {
+		if transport.StrictParsing {
+			pc.startCapture()
+		}
+		resp, err := http.ReadResponse(pc.br, req)
+		raw := pc.stopCapture()
+		if err != nil {
+			if pc.readLimit <= 0 {
+				err = fmt.Errorf("%w (limit %d bytes)", ErrResponseHeaderTooLarge, limit)
+			}
+			return nil, err
+		}
+		if raw != nil {
+			if err := checkStrictHeader(raw); err != nil {
+				return nil, err
+			}
+		}
+		code := resp.StatusCode
+		if code < 100 || code > 199 || code == http.StatusSwitchingProtocols {
+			return resp, nil
+		}
+		if trace != nil {
+			if code == http.StatusContinue && trace.Got100Continue != nil {
+				trace.Got100Continue()
+			}
+			if trace.Got1xxResponse != nil {
+				if err := trace.Got1xxResponse(code, textproto.MIMEHeader(resp.Header)); err != nil {
+					return nil, err
+				}
+			}
+		}
+		if code == http.StatusContinue && stopAtContinue {
+			return resp, nil
+		}
+	}
+}
+
+// errBodySkipped ends the write of a request whose body the server turned
+// down.
+var errBodySkipped = errors.New("http+npipe: request body skipped")
+
+// dialPipe connects to pipeName, giving up early if ctx is done first.
+func dialPipe(ctx context.Context, pipeName string, timeout time.Duration) (net.Conn, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return dialAsync(ctx, func() (net.Conn, error) {
+		return sockets.DialPipe(pipeName, timeout)
+	})
+}
+
+// dialAsync runs dial, which cannot be cancelled, giving up early if ctx is
+// done first; the connection dial makes after all is then closed.
+func dialAsync(ctx context.Context, dial func() (net.Conn, error)) (net.Conn, error) {
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		c, err := dial()
+		ch <- result{c, err}
+	}()
+
+	select {
+	case res := <-ch:
+		return res.conn, res.err
+	case <-ctx.Done():
+		go func() {
+			if res := <-ch; res.conn != nil {
+				res.conn.Close()
+			}
+		}()
+		return nil, ctx.Err()
+	}
+}
+
+// deadline returns the earlier of timeout from now and the deadline of
+// ctx. The zero Time means neither applies.
+func deadline(ctx context.Context, timeout time.Duration) time.Time {
+	var d time.Time
+	if timeout > 0 {
+		d = time.Now().Add(timeout)
+	}
+	if ctxDeadline, ok := ctx.Deadline(); ok && (d.IsZero() || ctxDeadline.Before(d)) {
+		d = ctxDeadline
+	}
+	return d
+}
+
+// earliest returns the earlier of two deadlines, where the zero Time
+// stands for no deadline.
+func earliest(a, b time.Time) time.Time {
+	if a.IsZero() || (!b.IsZero() && b.Before(a)) {
+		return b
+	}
+	return a
+}
+
+// contextError stops watching the request context and reports the context
+// error in place of err if the context was the reason the connection
+// failed, either by being cancelled or by its deadline passing.
+func contextError(ctx context.Context, stop func() bool, err error) error {
+	if !stop() && ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if d, ok := ctx.Deadline(); ok && !time.Now().Before(d) {
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			return context.DeadlineExceeded
+		}
+	}
+	return err
+}
+
+// body wraps a response body that is still subject to the request
+// context. Reading past a cancellation reports the context error. Once the
+// body is read to the end or closed, the connection is released: back to
+// the pool if it can carry another request, closed otherwise. A body with
+// neither a Content-Length nor chunked encoding, as HTTP/1.0 servers send,
+// ends where the server closes the pipe, so its connection is never
+// pooled; keepAlive sees to that.
+type body struct {
+	io.ReadCloser
+	ctx         context.Context
+	stop        func() bool
+	conn        net.Conn
+	readTimeout time.Duration
+	release     func(reusable bool)
+	once        sync.Once
+	released    atomic.Bool
+	watch       *streamWatch  // for StreamKeepAlive, if the body is streamed
+	br          *bufio.Reader // the connection's, for StrictContentLength
+}
+
+func (b *body) Read(p []byte) (int, error) {
+	if b.released.Load() {
+		// The connection may carry another request by now, so it is left
+		// alone; the body itself reports EOF, or that it is closed.
+		return b.ReadCloser.Read(p)
+	}
+	if b.readTimeout > 0 {
+		b.conn.SetReadDeadline(deadline(b.ctx, b.readTimeout))
+	}
+	n, err := b.ReadCloser.Read(p)
+	switch {
+	case err == io.EOF && b.overran():
+		b.finish(func() {
+			b.stop()
+			b.release(false)
+		})
+		err = fmt.Errorf("%w: more data follows the body", ErrContentLengthMismatch)
+	case err == io.EOF:
+		b.finish(func() { b.release(b.stop()) })
+	case err == io.ErrUnexpectedEOF && b.br != nil:
+		err = fmt.Errorf("%w: body cut short", ErrContentLengthMismatch)
+	case err != nil:
+		err = b.watch.failed(contextError(b.ctx, b.stop, err))
+	}
+	return n, err
+}
+
+// finish runs release the first time it is called, and reports whether it
+// did. From then on the body does not touch the connection.
+func (b *body) finish(release func()) bool {
+	ran := false
+	b.once.Do(func() {
+		b.released.Store(true)
+		release()
+		ran = true
+	})
+	return ran
+}
+
+// overran reports whether, under StrictContentLength, more data has come in
+// than the response declared.
+func (b *body) overran() bool {
+	return b.br != nil && b.br.Buffered() > 0
+}
+
+// Close closes the connection if the body has not been read to the end,
+// rather than waiting for whatever the server still has to send. What has
+// already arrived is still read, so that a caller which stops just short of
+// EOF gets the trailers and keeps the connection reusable.
+func (b *body) Close() error {
+	early := b.finish(func() {
+		b.release(b.stop() && b.drainBuffered())
+	})
+	err := b.ReadCloser.Close()
+	if early {
+		return nil
+	}
+	return err
+}
+
+// aLongTimeAgo is a deadline that has always passed.
+var aLongTimeAgo = time.Unix(1, 0)
+
+// drainBuffered reads the rest of the body without waiting on the pipe,
+// and reports whether that reached the end of it.
+func (b *body) drainBuffered() bool {
+	b.conn.SetReadDeadline(aLongTimeAgo)
+	_, err := io.Copy(io.Discard, b.ReadCloser)
+	return err == nil && !b.overran()
 }
@@ -0,0 +1,363 @@
+/*
+   Copyright 2018 Docker, Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package httpnpipe
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// readRequest reads one request from c, with its body.
+func readRequest(c net.Conn) error {
+	req, err := http.ReadRequest(bufio.NewReader(c))
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(io.Discard, req.Body)
+	return err
+}
+
+func TestRoundTripClosesConnOnError(t *testing.T) {
+	errInjected := errors.New("injected failure")
+	tests := []struct {
+		name  string
+		pipes *fakePipes
+	}{
+		{"write fails", &fakePipes{failWrite: errInjected}},
+		{"read fails", &fakePipes{failRead: errInjected, serve: func(c net.Conn) {
+			readRequest(c)
+			io.Copy(io.Discard, c)
+		}}},
+		{"server hangs up", &fakePipes{serve: func(c net.Conn) {
+			readRequest(c)
+		}}},
+		{"malformed response", &fakePipes{serve: func(c net.Conn) {
+			readRequest(c)
+			io.WriteString(c, "HTTP/1.1 ???\r\n\r\n")
+		}}},
+		{"bad content length", &fakePipes{serve: func(c net.Conn) {
+			readRequest(c)
+			io.WriteString(c, "HTTP/1.1 200 OK\r\nContent-Length: x\r\n\r\n")
+		}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			transport := &Transport{}
+			defer transport.Close()
+			if err := transport.RegisterTargetDialer("svc", tt.pipes.dial); err != nil {
+				t.Fatal(err)
+			}
+			req, _ := http.NewRequest(http.MethodPost, "http+npipe://svc/", strings.NewReader("body"))
+			resp, err := transport.RoundTrip(req)
+			if err == nil {
+				resp.Body.Close()
+				t.Fatal("RoundTrip succeeded")
+			}
+			if tt.pipes.dialed.Load() == 0 {
+				t.Fatal("no connection dialed")
+			}
+			if n := tt.pipes.leaked(); n != 0 {
+				t.Errorf("%d connections left open after %v", n, err)
+			}
+		})
+	}
+}
+
+func TestCloseDelimitedBody(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+	}{
+		{"HTTP/1.0", "HTTP/1.0 200 OK\r\n\r\n"},
+		{"HTTP/1.0 with Content-Length", "HTTP/1.0 200 OK\r\nContent-Length: 11\r\n\r\n"},
+		{"HTTP/1.1 without length", "HTTP/1.1 200 OK\r\n\r\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pipes := &fakePipes{serve: func(c net.Conn) {
+				// A minimal server: one request per connection, and the
+				// body written in pieces before hanging up.
+				readRequest(c)
+				io.WriteString(c, tt.header+"hello ")
+				time.Sleep(10 * time.Millisecond)
+				io.WriteString(c, "world")
+			}}
+			transport := &Transport{}
+			defer transport.Close()
+			if err := transport.RegisterTargetDialer("svc", pipes.dial); err != nil {
+				t.Fatal(err)
+			}
+			client := &http.Client{Transport: transport}
+			for i := 0; i < 2; i++ {
+				body, err := getBody(client, "http+npipe://svc/")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if body != "hello world" {
+					t.Fatalf("body %q, want %q", body, "hello world")
+				}
+			}
+			if n := pipes.dialed.Load(); n != 2 {
+				t.Errorf("%d connections dialed for 2 requests, want 2", n)
+			}
+			if n := pipes.leaked(); n != 0 {
+				t.Errorf("%d connections left open", n)
+			}
+		})
+	}
+}
+
+// serveReplies returns a fakePipes server that answers every request on a
+// connection with what reply gives for it, keeping the connection open.
+func serveReplies(reply func(req *http.Request) string) func(c net.Conn) {
+	return func(c net.Conn) {
+		br := bufio.NewReader(c)
+		for {
+			req, err := http.ReadRequest(br)
+			if err != nil {
+				return
+			}
+			io.Copy(io.Discard, req.Body)
+			if _, err := io.WriteString(c, reply(req)); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func TestBodylessResponses(t *testing.T) {
+	tests := []struct {
+		name   string
+		method string
+		reply  string
+	}{
+		{"HEAD", http.MethodHead, "HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\n"},
+		{"204", http.MethodGet, "HTTP/1.1 204 No Content\r\n\r\n"},
+		{"304", http.MethodGet, "HTTP/1.1 304 Not Modified\r\nContent-Length: 5\r\n\r\n"},
+		{"Content-Length 0", http.MethodGet, "HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pipes := &fakePipes{serve: serveReplies(func(*http.Request) string { return tt.reply })}
+			transport := &Transport{RequestTimeout: 5 * time.Second}
+			defer transport.Close()
+			if err := transport.RegisterTargetDialer("svc", pipes.dial); err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < 3; i++ {
+				req, _ := http.NewRequest(tt.method, "http+npipe://svc/", nil)
+				resp, err := transport.RoundTrip(req)
+				if err != nil {
+					t.Fatal(err)
+				}
+				// The connection is reusable before the body is touched.
+				if n := idleConns(transport, "svc"); n != 1 {
+					t.Errorf("%d idle connections before reading the body, want 1", n)
+				}
+				body, err := io.ReadAll(resp.Body)
+				resp.Body.Close()
+				if err != nil || len(body) != 0 {
+					t.Fatalf("body %q, %v; want an empty one", body, err)
+				}
+			}
+			if n := pipes.dialed.Load(); n != 1 {
+				t.Errorf("%d connections dialed for 3 requests, want 1", n)
+			}
+		})
+	}
+}
+
+func TestBodylessReadLeavesReusedConn(t *testing.T) {
+	pipes := &fakePipes{serve: serveReplies(func(req *http.Request) string {
+		if req.URL.Path == "/slow" {
+			time.Sleep(300 * time.Millisecond)
+		}
+		return "HTTP/1.1 204 No Content\r\n\r\n"
+	})}
+	transport := &Transport{
+		ResponseHeaderTimeout: 100 * time.Millisecond,
+		BodyReadTimeout:       time.Hour,
+	}
+	defer transport.Close()
+	if err := transport.RegisterTargetDialer("svc", pipes.dial); err != nil {
+		t.Fatal(err)
+	}
+	req, _ := http.NewRequest(http.MethodGet, "http+npipe://svc/", nil)
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The connection is already back in the pool, and the next request
+	// takes it while the first body is still to be read.
+	slow := make(chan error, 1)
+	go func() {
+		req, _ := http.NewRequest(http.MethodGet, "http+npipe://svc/slow", nil)
+		resp, err := transport.RoundTrip(req)
+		if err == nil {
+			resp.Body.Close()
+		}
+		slow <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	var netErr net.Error
+	if err := <-slow; !errors.As(err, &netErr) || !netErr.Timeout() {
+		t.Errorf("slow request got %v, want its ResponseHeaderTimeout", err)
+	}
+}
+
+// trailerBody is a request body that fills in the request's trailer once
+// it has been read to the end, as a checksum would be.
+type trailerBody struct {
+	io.Reader
+	trailer http.Header
+}
+
+func (b *trailerBody) Read(p []byte) (int, error) {
+	n, err := b.Reader.Read(p)
+	if err == io.EOF {
+		b.trailer.Set("X-Checksum", "5d41402a")
+	}
+	return n, err
+}
+
+func TestRequestTrailers(t *testing.T) {
+	server := startTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		io.WriteString(w, string(body)+" "+r.Trailer.Get("X-Checksum"))
+	})
+	tests := []struct {
+		name      string
+		transport *Transport
+		expect    bool
+	}{
+		{"no timeouts", &Transport{}, false},
+		{"write timeouts", &Transport{HeaderWriteTimeout: time.Second, BodyWriteTimeout: time.Second}, false},
+		{"expect continue", &Transport{ExpectContinueTimeout: time.Second}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			transport := tt.transport
+			defer transport.Close()
+			transport.RegisterTargetService("svc", server.path)
+			trailer := http.Header{"X-Checksum": nil}
+			req, _ := http.NewRequest(http.MethodPut, "http+npipe://svc/", nil)
+			req.Body = io.NopCloser(&trailerBody{Reader: strings.NewReader("hello"), trailer: trailer})
+			req.ContentLength = 5
+			req.Trailer = trailer
+			if tt.expect {
+				req.Header.Set("Expect", "100-continue")
+			}
+			resp, err := transport.RoundTrip(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, err := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := "hello 5d41402a"; string(body) != want {
+				t.Errorf("server saw %q, want %q", body, want)
+			}
+			if req.ContentLength != 5 {
+				t.Errorf("request ContentLength changed to %d", req.ContentLength)
+			}
+		})
+	}
+}
+
+func TestValidateOnRegister(t *testing.T) {
+	missing := filepath.Join(t.TempDir(), "missing.sock")
+	transport := &Transport{ValidateOnRegister: true}
+	defer transport.Close()
+	if err := transport.RegisterTargetServiceErr("checked", missing); err == nil {
+		t.Error("RegisterTargetServiceErr accepted an endpoint that cannot be reached")
+	}
+	if _, ok := transport.LookupService("checked"); ok {
+		t.Error("service registered despite failing validation")
+	}
+	// A missing pipe is no reason to panic.
+	transport.RegisterTargetService("unchecked", missing)
+	if _, ok := transport.LookupService("unchecked"); !ok {
+		t.Error("RegisterTargetService did not register the service")
+	}
+}
+
+func TestStaleRetryClosesRewoundBody(t *testing.T) {
+	pipes := &fakePipes{serve: func(c net.Conn) {
+		// Answer one request, then hang up, as a server closing an idle
+		// connection would.
+		readRequest(c)
+		io.WriteString(c, "HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n")
+	}}
+	errDial := errors.New("dial refused")
+	var dials atomic.Int32
+	transport := &Transport{}
+	defer transport.Close()
+	err := transport.RegisterTargetDialer("svc", func(ctx context.Context) (net.Conn, error) {
+		if dials.Add(1) > 1 {
+			return nil, errDial
+		}
+		return pipes.dial(ctx)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{Transport: transport}
+	if _, err := getBody(client, "http+npipe://svc/"); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the connection to be pooled", func() bool { return idleConns(transport, "svc") == 1 })
+
+	var rewound []*trackedBody
+	req, _ := http.NewRequest(http.MethodPut, "http+npipe://svc/", strings.NewReader("body"))
+	req.GetBody = func() (io.ReadCloser, error) {
+		b := &trackedBody{Reader: strings.NewReader("body")}
+		rewound = append(rewound, b)
+		return b, nil
+	}
+	req.Header.Set("Idempotency-Key", "1")
+	resp, err := transport.RoundTrip(req)
+	if err == nil {
+		resp.Body.Close()
+		t.Fatal("RoundTrip succeeded with no connection to retry on")
+	}
+	if !errors.Is(err, errDial) {
+		t.Fatalf("got %v, want the retry's dial error", err)
+	}
+	if len(rewound) == 0 {
+		t.Fatal("request not retried on a fresh connection")
+	}
+	for _, b := range rewound {
+		if !b.closed.Load() {
+			t.Error("rewound request body left open")
+		}
+	}
+}
@@ -0,0 +1,80 @@
+/*
+   Copyright 2018 Docker, Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package httpnpipetest provides utilities for end-to-end tests of HTTP
+// over named pipes, after net/http/httptest.
+package httpnpipetest
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"sync/atomic"
+
+	"github.com/docker/httpnpipe"
+)
+
+// Service is the service name under which a Server's Transport reaches it.
+const Service = "httpnpipetest"
+
+var serial int64
+
+// A Server is an HTTP server listening on a pipe of its own, for use in
+// end-to-end tests.
+type Server struct {
+	// PipeName is the pipe the server listens on.
+	PipeName string
+	// URL is the base URL of the server, http+npipe://httpnpipetest,
+	// without a trailing slash.
+	URL string
+	// Transport has Service registered for the server's pipe, and Client
+	// uses Transport.
+	Transport *httpnpipe.Transport
+	Client    *http.Client
+
+	server *httpnpipe.Server
+}
+
+// NewServer starts and returns a new Server serving handler on a newly
+// created pipe with a unique name. The caller should call Close when
+// finished, to shut it down. NewServer panics if the pipe cannot be
+// created.
+func NewServer(handler http.Handler) *Server {
+	pipeName := fmt.Sprintf(`%shttpnpipetest-%d-%d`, httpnpipe.PipeDir, os.Getpid(), atomic.AddInt64(&serial, 1))
+	l, err := httpnpipe.ListenPipe(pipeName, nil)
+	if err != nil {
+		panic(fmt.Sprintf("httpnpipetest: failed to listen on %s: %v", pipeName, err))
+	}
+
+	transport := &httpnpipe.Transport{}
+	transport.RegisterTargetService(Service, pipeName)
+	s := &Server{
+		PipeName:  pipeName,
+		URL:       httpnpipe.Scheme + "://" + Service,
+		Transport: transport,
+		Client:    &http.Client{Transport: transport},
+		server:    &httpnpipe.Server{Handler: handler},
+	}
+	go s.server.Serve(l)
+	return s
+}
+
+// Close shuts down the server, closing the pipe and any connections to it,
+// and the idle connections of its Transport.
+func (s *Server) Close() {
+	s.server.Close()
+	s.Transport.Close()
+}
@@ -0,0 +1,61 @@
+/*
+   Copyright 2018 Docker, Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package httpnpipetest
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestNewServer(t *testing.T) {
+	s := NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.URL.Path)
+	}))
+	if !strings.HasPrefix(s.PipeName, `\\.\pipe\httpnpipetest-`) {
+		t.Errorf("PipeName = %q, want a pipe named after the package", s.PipeName)
+	}
+	resp, err := s.Client.Get(s.URL + "/hello")
+	if err != nil {
+		s.Close()
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		s.Close()
+		t.Fatal(err)
+	}
+	if string(body) != "/hello" {
+		t.Errorf("got body %q, want %q", body, "/hello")
+	}
+
+	other := NewServer(http.NotFoundHandler())
+	defer other.Close()
+	if other.PipeName == s.PipeName {
+		t.Errorf("two servers share the pipe %q", s.PipeName)
+	}
+
+	s.Close()
+	client := &http.Client{Transport: other.Transport}
+	other.Transport.RegisterTargetService("closed", s.PipeName)
+	if resp, err := client.Get("http+npipe://closed/"); err == nil {
+		resp.Body.Close()
+		t.Error("request to a closed server succeeded")
+	}
+}
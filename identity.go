@@ -0,0 +1,73 @@
+/*
+   Copyright 2018 Docker, Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package httpnpipe
+
+import (
+	"context"
+	"net"
+)
+
+// ClientIdentity describes the client at the other end of a pipe
+// connection to a Server, for handlers to make access decisions on.
+type ClientIdentity struct {
+	// ProcessID is the ID of the client's process. For a client on
+	// another machine it is whatever the client reported.
+	ProcessID uint32
+	// SID is the security identifier of the user the client runs as, in
+	// string form such as S-1-5-18, or empty if it could not be found.
+	SID string
+	// Groups holds the SIDs of the groups the client's user belongs to,
+	// as far as they are enabled for it, if they could be found.
+	Groups []string
+}
+
+type clientIdentityKey struct{}
+
+// ClientIdentityFromContext returns the identity of the client that sent
+// a request to a Server, given the request's context. It reports false if
+// the identity is unknown, as it is for connections other than pipe ones
+// and for clients on other machines that do not allow impersonation.
+func ClientIdentityFromContext(ctx context.Context) (ClientIdentity, bool) {
+	id, ok := ctx.Value(clientIdentityKey{}).(ClientIdentity)
+	return id, ok
+}
+
+// withClientIdentity returns ctx carrying the identity of the client
+// behind c, if it can be found.
+func withClientIdentity(ctx context.Context, c net.Conn) context.Context {
+	id, ok := connIdentity(c)
+	if !ok {
+		return ctx
+	}
+	return context.WithValue(ctx, clientIdentityKey{}, id)
+}
+
+// connIdentity returns the identity of the client behind c, as found when
+// it was accepted if it was, or else by finding it out from the pipe under
+// the wrappers c may be in.
+func connIdentity(c net.Conn) (ClientIdentity, bool) {
+	for {
+		switch conn := c.(type) {
+		case *policyConn:
+			return conn.client, conn.known
+		case interface{ NetConn() net.Conn }:
+			c = conn.NetConn()
+		default:
+			return clientIdentity(c)
+		}
+	}
+}
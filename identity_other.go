@@ -0,0 +1,33 @@
+//go:build !windows
+
+/*
+   Copyright 2018 Docker, Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package httpnpipe
+
+import "net"
+
+// clientIdentity finds out who is at the other end of the server side of
+// pipe connection c. There are no pipes to ask about outside Windows.
+func clientIdentity(c net.Conn) (ClientIdentity, bool) {
+	return ClientIdentity{}, false
+}
+
+// currentUserSID returns the SID of the user the process runs as. Outside
+// Windows there are no SIDs.
+func currentUserSID() (string, error) {
+	return "", ErrPipesUnsupported
+}
@@ -0,0 +1,163 @@
+//go:build windows
+
+/*
+   Copyright 2018 Docker, Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package httpnpipe
+
+import (
+	"net"
+	"runtime"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+var (
+	modkernel32 = windows.NewLazySystemDLL("kernel32.dll")
+	modadvapi32 = windows.NewLazySystemDLL("advapi32.dll")
+
+	procGetNamedPipeClientProcessId    = modkernel32.NewProc("GetNamedPipeClientProcessId")
+	procGetNamedPipeClientComputerName = modkernel32.NewProc("GetNamedPipeClientComputerNameW")
+	procImpersonateNamedPipeClient     = modadvapi32.NewProc("ImpersonateNamedPipeClient")
+)
+
+// clientIdentity finds out who is at the other end of the server side of
+// pipe connection c.
+func clientIdentity(c net.Conn) (ClientIdentity, bool) {
+	f, ok := c.(interface{ Fd() uintptr })
+	if !ok {
+		return ClientIdentity{}, false
+	}
+	handle := windows.Handle(f.Fd())
+	var pid uint32
+	if r, _, _ := procGetNamedPipeClientProcessId.Call(uintptr(handle), uintptr(unsafe.Pointer(&pid))); r == 0 {
+		return ClientIdentity{}, false
+	}
+	id := ClientIdentity{ProcessID: pid}
+	if sid, groups, err := impersonatedUser(handle); err == nil {
+		id.SID, id.Groups = sid, groups
+	} else if !isLocalClient(handle) {
+		// A client on another machine reports its process ID itself, so
+		// it says nothing about who the client is.
+		return ClientIdentity{}, false
+	} else if sid, groups, err := processUser(pid); err == nil {
+		// Clients that only allow anonymous impersonation, as most do,
+		// are still known by their process.
+		id.SID, id.Groups = sid, groups
+	}
+	return id, true
+}
+
+// isLocalClient reports whether the client of pipe runs on this machine.
+// Windows only says so by failing to name the client's computer with
+// ERROR_PIPE_LOCAL; any other answer counts as a remote client.
+func isLocalClient(pipe windows.Handle) bool {
+	var name [windows.MAX_COMPUTERNAME_LENGTH + 1]uint16
+	r, _, err := procGetNamedPipeClientComputerName.Call(uintptr(pipe), uintptr(unsafe.Pointer(&name[0])), unsafe.Sizeof(name))
+	return r == 0 && err == windows.ERROR_PIPE_LOCAL
+}
+
+// impersonatedUser returns the user and group SIDs of the client of pipe
+// by impersonating it.
+func impersonatedUser(pipe windows.Handle) (string, []string, error) {
+	type result struct {
+		sid    string
+		groups []string
+		err    error
+	}
+	ch := make(chan result, 1)
+	// Impersonation applies to the thread, so it is done on a goroutine of
+	// its own, locked to its thread. Should reverting fail, the goroutine
+	// ends still locked, which ends the thread too.
+	go func() {
+		runtime.LockOSThread()
+		if r, _, err := procImpersonateNamedPipeClient.Call(uintptr(pipe)); r == 0 {
+			runtime.UnlockOSThread()
+			ch <- result{"", nil, err}
+			return
+		}
+		var token windows.Token
+		err := windows.OpenThreadToken(windows.CurrentThread(), windows.TOKEN_QUERY, true, &token)
+		if revertErr := windows.RevertToSelf(); revertErr != nil {
+			if err == nil {
+				token.Close()
+			}
+			ch <- result{"", nil, revertErr}
+			return
+		}
+		runtime.UnlockOSThread()
+		if err != nil {
+			ch <- result{"", nil, err}
+			return
+		}
+		defer token.Close()
+		sid, groups, err := tokenUser(token)
+		ch <- result{sid, groups, err}
+	}()
+	res := <-ch
+	return res.sid, res.groups, res.err
+}
+
+// processUser returns the user and group SIDs of process pid.
+func processUser(pid uint32) (string, []string, error) {
+	process, err := windows.OpenProcess(windows.PROCESS_QUERY_LIMITED_INFORMATION, false, pid)
+	if err != nil {
+		return "", nil, err
+	}
+	defer windows.CloseHandle(process)
+	var token windows.Token
+	if err := windows.OpenProcessToken(process, windows.TOKEN_QUERY, &token); err != nil {
+		return "", nil, err
+	}
+	defer token.Close()
+	return tokenUser(token)
+}
+
+// tokenUser returns the user SID of token and the SIDs of the groups
+// enabled in it. Groups that are only for denying access, such as
+// Administrators in a filtered admin token, are left out.
+func tokenUser(token windows.Token) (string, []string, error) {
+	user, err := token.GetTokenUser()
+	if err != nil {
+		return "", nil, err
+	}
+	tokenGroups, err := token.GetTokenGroups()
+	if err != nil {
+		return "", nil, err
+	}
+	var groups []string
+	for _, g := range tokenGroups.AllGroups() {
+		if g.Attributes&windows.SE_GROUP_ENABLED != 0 && g.Attributes&windows.SE_GROUP_USE_FOR_DENY_ONLY == 0 {
+			groups = append(groups, g.Sid.String())
+		}
+	}
+	return user.User.Sid.String(), groups, nil
+}
+
+// currentUserSID returns the SID of the user the process runs as.
+func currentUserSID() (string, error) {
+	token, err := windows.OpenCurrentProcessToken()
+	if err != nil {
+		return "", err
+	}
+	defer token.Close()
+	user, err := token.GetTokenUser()
+	if err != nil {
+		return "", err
+	}
+	return user.User.Sid.String(), nil
+}
@@ -0,0 +1,155 @@
+/*
+   Copyright 2018 Docker, Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package httpnpipe
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// streamWatch checks on the server behind a long-lived stream every
+// StreamKeepAlive, until the stream is closed, and closes the stream's
+// connection if the server fails to answer. A nil *streamWatch watches
+// nothing.
+type streamWatch struct {
+	pc       *persistConn
+	done     chan struct{}
+	mutex    sync.Mutex
+	closed   bool
+	err      error // why the connection was closed, if it was
+	interval time.Duration
+}
+
+// watchStream starts watching the stream over pc, if StreamKeepAlive asks
+// for it.
+func (transport *Transport) watchStream(pc *persistConn) *streamWatch {
+	if transport.StreamKeepAlive <= 0 {
+		return nil
+	}
+	w := &streamWatch{pc: pc, done: make(chan struct{}), interval: transport.StreamKeepAlive}
+	go w.run()
+	return w
+}
+
+func (w *streamWatch) run() {
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.done:
+			return
+		case <-ticker.C:
+		}
+		if err := w.pc.transport.ping(w.pc, w.interval); err != nil {
+			w.fail(fmt.Errorf("%w: %s: %v", ErrStreamUnresponsive, w.pc.service, err))
+			return
+		}
+	}
+}
+
+// fail closes the connection, unless the stream is done with it already.
+func (w *streamWatch) fail(err error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.closed {
+		return
+	}
+	w.err = err
+	w.closed = true
+	close(w.done)
+	w.pc.close()
+}
+
+// close stops the watch. It is called before the connection is released.
+func (w *streamWatch) close() {
+	if w == nil {
+		return
+	}
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if !w.closed {
+		w.closed = true
+		close(w.done)
+	}
+}
+
+// failed returns the reason the watch closed the connection in place of
+// err, the error reading or writing it ran into, if it did.
+func (w *streamWatch) failed(err error) error {
+	if w == nil {
+		return err
+	}
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.err != nil {
+		return w.err
+	}
+	return err
+}
+
+// ping sends "OPTIONS *" to the server at the other end of pc, over another
+// connection, and reports whether it answered within timeout. Any answer
+// will do; it shows the server is still serving. When MaxConnsPerService
+// leaves no connection to send it on, the check is skipped: waiting for one
+// would only use up the timeout.
+func (transport *Transport) ping(pc *persistConn, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	ctx = context.WithValue(ctx, noWaitKey{}, true)
+	req := (&http.Request{
+		Method: http.MethodOptions,
+		URL:    &url.URL{Scheme: Scheme, Host: pc.service, Path: "*"},
+		Header: make(http.Header),
+	}).WithContext(ctx)
+	if pc.secure {
+		req.URL.Scheme = SchemeTLS
+	}
+
+	var resp *http.Response
+	var err error
+	if transport.useHTTP2(pc.pipeName) {
+		resp, err = transport.roundTripHTTP2(req, pc.service, pc.pipeName)
+	} else {
+		resp, err = transport.pingConn(ctx, pc, req, true)
+		var stale *staleConnError
+		if errors.As(err, &stale) {
+			resp, err = transport.pingConn(ctx, pc, req, false)
+		}
+	}
+	if errors.Is(err, errNoConnFree) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// pingConn sends req on a connection to the pipe of pc, taken from the pool
+// if reuse allows.
+func (transport *Transport) pingConn(ctx context.Context, pc *persistConn, req *http.Request, reuse bool) (*http.Response, error) {
+	conn, err := transport.getConn(ctx, pc.service, pc.pipeName, pc.secure, reuse)
+	if err != nil {
+		return nil, err
+	}
+	return transport.roundTrip(ctx, conn, req)
+}
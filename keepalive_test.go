@@ -0,0 +1,56 @@
+/*
+   Copyright 2018 Docker, Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package httpnpipe
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestStreamKeepAliveAtConnLimit(t *testing.T) {
+	server := startTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodOptions {
+			return
+		}
+		// A stream that stays quiet for several keep-alive intervals.
+		for i := 0; i < 3; i++ {
+			io.WriteString(w, "tick\n")
+			w.(http.Flusher).Flush()
+			time.Sleep(100 * time.Millisecond)
+		}
+	})
+	// Every place is held by the stream, so no check can be sent.
+	transport := &Transport{StreamKeepAlive: 30 * time.Millisecond, MaxConnsPerService: 1}
+	defer transport.Close()
+	transport.RegisterTargetService("svc", server.path)
+	req, _ := http.NewRequestWithContext(WithStreaming(context.Background()), http.MethodGet, "http+npipe://svc/", nil)
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("stream failed after %q: %v", body, err)
+	}
+	if want := "tick\ntick\ntick\n"; string(body) != want {
+		t.Errorf("stream %q, want %q", body, want)
+	}
+}
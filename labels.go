@@ -0,0 +1,63 @@
+/*
+   Copyright 2018 Docker, Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package httpnpipe
+
+// A RegisterOption adds to the registration of a service.
+type RegisterOption func(*registration)
+
+type registration struct {
+	labels    map[string]string
+	streaming bool
+	framed    bool
+	// negotiated is set by WithProtocolNegotiation
+	negotiated bool
+}
+
+// WithLabels attaches labels to a service, such as its tenant, version or
+// environment, for logging and metrics hooks to tell services apart. They
+// are available from ServiceLabels until the service is unregistered or
+// remapped.
+func WithLabels(labels map[string]string) RegisterOption {
+	copied := make(map[string]string, len(labels))
+	for key, value := range labels {
+		copied[key] = value
+	}
+	return func(r *registration) {
+		r.labels = copied
+	}
+}
+
+// ServiceLabels returns a copy of the labels registered for serviceName or
+// the service it is an alias of, or nil if there are none.
+func (transport *Transport) ServiceLabels(serviceName string) map[string]string {
+	return transport.Registry().Labels(serviceName)
+}
+
+// Labels returns a copy of the labels registered for serviceName, as
+// described for Transport.ServiceLabels.
+func (reg *Registry) Labels(serviceName string) map[string]string {
+	r := reg.current()
+	labels, ok := r.labels[r.canonical(serviceName)]
+	if !ok {
+		return nil
+	}
+	copied := make(map[string]string, len(labels))
+	for key, value := range labels {
+		copied[key] = value
+	}
+	return copied
+}
@@ -0,0 +1,103 @@
+/*
+   Copyright 2018 Docker, Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package httpnpipe
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+// connLimit is a maximum number of connections open at a time, shared by
+// the listeners of a Server.
+type connLimit struct {
+	slots    chan struct{}
+	reject   bool
+	rejected atomic.Uint64
+}
+
+// limitListener holds the connections accepted from a listener under a
+// connLimit, either by not accepting more until one closes, or by closing
+// the excess ones at once.
+type limitListener struct {
+	net.Listener
+	*connLimit
+	done chan struct{}
+	once sync.Once
+}
+
+func newLimitListener(l net.Listener, limit *connLimit) *limitListener {
+	return &limitListener{
+		Listener:  l,
+		connLimit: limit,
+		done:      make(chan struct{}),
+	}
+}
+
+func (l *limitListener) Accept() (net.Conn, error) {
+	for {
+		if !l.reject {
+			// Leaving connections to wait on the pipe, rather than
+			// accepting them, pushes back on the clients.
+			select {
+			case l.slots <- struct{}{}:
+			case <-l.done:
+				return nil, net.ErrClosed
+			}
+		}
+		c, err := l.Listener.Accept()
+		if err != nil {
+			if !l.reject {
+				<-l.slots
+			}
+			return nil, err
+		}
+		if l.reject {
+			select {
+			case l.slots <- struct{}{}:
+			default:
+				l.rejected.Add(1)
+				c.Close()
+				continue
+			}
+		}
+		return &limitConn{Conn: c, release: func() { <-l.slots }}, nil
+	}
+}
+
+func (l *limitListener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return l.Listener.Close()
+}
+
+// limitConn gives up its place under the limit when closed.
+type limitConn struct {
+	net.Conn
+	release func()
+	once    sync.Once
+}
+
+func (c *limitConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.release)
+	return err
+}
+
+// NetConn returns the connection c wraps.
+func (c *limitConn) NetConn() net.Conn {
+	return c.Conn
+}
@@ -0,0 +1,67 @@
+/*
+   Copyright 2018 Docker, Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package httpnpipe
+
+import "net"
+
+// ListenConfig configures the pipe created by ListenPipe. The zero value
+// gives a byte-mode pipe with the default security descriptor of the
+// system and buffers of DefaultPipeBufferSize.
+type ListenConfig struct {
+	// SecurityDescriptor, in SDDL form, controls who may connect to the
+	// pipe: one of SDDLAdminsOnly, SDDLEveryone or SDDLSameUser, say. Empty
+	// means the default security of the process.
+	SecurityDescriptor string
+
+	// MessageMode, if true, creates a message-mode pipe, which is needed
+	// for clients to signal the end of a request body with CloseWrite.
+	MessageMode bool
+
+	// InputBufferSize and OutputBufferSize size the pipe's buffers, in
+	// bytes. Zero means DefaultPipeBufferSize, and a negative size the
+	// system's default, which is small for bulk transfers.
+	InputBufferSize  int32
+	OutputBufferSize int32
+}
+
+// DefaultPipeBufferSize is the size of the buffers of pipes from ListenPipe
+// unless their ListenConfig says otherwise. It matches the Docker Engine's
+// pipes, which carry large payloads such as image layers.
+const DefaultPipeBufferSize = 64 << 10
+
+// pipeBufferSize returns the buffer size to create a pipe with, given the
+// configured one; zero asks the system for its default.
+func pipeBufferSize(size int32) int32 {
+	switch {
+	case size == 0:
+		return DefaultPipeBufferSize
+	case size < 0:
+		return 0
+	}
+	return size
+}
+
+// Listen listens on endpoint, which is either a pipe path, such as
+// \\.\pipe\myapp, for ListenPipe to create with cfg, or else the path of a
+// unix socket. It lets a server offer the same endpoint setting on all
+// systems.
+func Listen(endpoint string, cfg *ListenConfig) (net.Listener, error) {
+	if host, _ := pipeHost(endpoint); host == "" {
+		return net.Listen("unix", endpoint)
+	}
+	return ListenPipe(endpoint, cfg)
+}
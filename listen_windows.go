@@ -0,0 +1,41 @@
+//go:build windows
+
+/*
+   Copyright 2018 Docker, Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package httpnpipe
+
+import (
+	"net"
+
+	"github.com/Microsoft/go-winio"
+)
+
+// ListenPipe creates the named pipe pipeName, such as \\.\pipe\myapp, and
+// returns a listener for the connections clients make to it, ready to be
+// given to http.Serve. A nil cfg means the zero ListenConfig. The pipe must
+// not exist already.
+func ListenPipe(pipeName string, cfg *ListenConfig) (net.Listener, error) {
+	if cfg == nil {
+		cfg = &ListenConfig{}
+	}
+	return winio.ListenPipe(pipeName, &winio.PipeConfig{
+		SecurityDescriptor: cfg.SecurityDescriptor,
+		MessageMode:        cfg.MessageMode,
+		InputBufferSize:    pipeBufferSize(cfg.InputBufferSize),
+		OutputBufferSize:   pipeBufferSize(cfg.OutputBufferSize),
+	})
+}
@@ -0,0 +1,45 @@
+/*
+   Copyright 2018 Docker, Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package httpnpipe
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// LocalEndpoint returns pipeName on Windows and socketPath elsewhere: the
+// endpoint through which a service that listens on either, depending on the
+// OS, is reached on this machine.
+func LocalEndpoint(pipeName string, socketPath string) string {
+	if runtime.GOOS == "windows" {
+		return pipeName
+	}
+	return socketPath
+}
+
+// RegisterLocalService maps serviceName to pipeName on Windows and to
+// socketPath elsewhere, so that http+local://serviceName/ reaches the service
+// the same way on every OS. Either may be empty when the service does not
+// run on that OS; registering then fails there, with an error wrapping
+// ErrInvalidPipeName. Otherwise it behaves like RegisterTargetServiceErr.
+func (transport *Transport) RegisterLocalService(serviceName string, pipeName string, socketPath string, opts ...RegisterOption) error {
+	target := LocalEndpoint(pipeName, socketPath)
+	if target == "" {
+		return fmt.Errorf("%w: no endpoint for service %q on %s", ErrInvalidPipeName, serviceName, runtime.GOOS)
+	}
+	return transport.RegisterTargetServiceErr(serviceName, target, opts...)
+}
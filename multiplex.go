@@ -0,0 +1,105 @@
+/*
+   Copyright 2018 Docker, Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package httpnpipe
+
+import (
+	"errors"
+	"net/http"
+
+	"golang.org/x/net/http2"
+)
+
+// HeaderMultiplex is the response header by which a Server with EnableH2C
+// set tells clients of HTTP/1.1 that it speaks HTTP/2 over its pipes too,
+// for a Transport with NegotiateHTTP2 set to switch to it.
+const HeaderMultiplex = "X-Pipe-Multiplex"
+
+// multiplexH2C is the value of HeaderMultiplex for HTTP/2 with prior
+// knowledge, h2c.
+const multiplexH2C = "h2c"
+
+// advertiseH2C has the HTTP/1 responses of handler carry HeaderMultiplex.
+func advertiseH2C(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor == 1 {
+			w.Header().Set(HeaderMultiplex, multiplexH2C)
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// useHTTP2 reports whether requests to pipeName go over HTTP/2, because
+// EnableHTTP2 is set, or because the server there has said it speaks it.
+func (transport *Transport) useHTTP2(pipeName string) bool {
+	if transport.EnableHTTP2 {
+		return true
+	}
+	if !transport.NegotiateHTTP2 {
+		return false
+	}
+	transport.mutex.Lock()
+	defer transport.mutex.Unlock()
+	return transport.h2Pipes[pipeName]
+}
+
+// noteMultiplex records that the server on pipeName speaks HTTP/2, if
+// resp says so.
+func (transport *Transport) noteMultiplex(pipeName string, resp *http.Response) {
+	if !transport.NegotiateHTTP2 || resp.Header.Get(HeaderMultiplex) != multiplexH2C {
+		return
+	}
+	transport.mutex.Lock()
+	defer transport.mutex.Unlock()
+	if transport.h2Pipes == nil {
+		transport.h2Pipes = make(map[string]bool)
+	}
+	transport.h2Pipes[pipeName] = true
+}
+
+// forgetMultiplex drops the record that the server on pipeName speaks
+// HTTP/2, after err failed a request for req there, and reports whether it
+// did. Only a failure of the connection, in dialing it or in the preface,
+// counts; a failed stream, or a request given up by its caller, says
+// nothing of the server.
+func (transport *Transport) forgetMultiplex(req *http.Request, pipeName string, err error) bool {
+	if transport.EnableHTTP2 || !transport.NegotiateHTTP2 || req.Context().Err() != nil {
+		return false
+	}
+	var streamErr http2.StreamError
+	if errors.As(err, &streamErr) || errors.Is(err, ErrTransportClosed) {
+		return false
+	}
+	transport.mutex.Lock()
+	defer transport.mutex.Unlock()
+	if !transport.h2Pipes[pipeName] {
+		return false
+	}
+	delete(transport.h2Pipes, pipeName)
+	return true
+}
+
+// forgetMultiplexLocked drops the records of the pipes that r routes no
+// service to any more; those of pipes named by URLs or the pipe template
+// go too, and are learned again from their next response. It must be
+// called with transport.mutex held.
+func (transport *Transport) forgetMultiplexLocked(r *routes) {
+	for pipeName := range transport.h2Pipes {
+		if !r.routesTo(pipeName) {
+			delete(transport.h2Pipes, pipeName)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+/*
+   Copyright 2018 Docker, Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package httpnpipe
+
+import (
+	"io"
+	"net/http"
+	"sync/atomic"
+	"testing"
+)
+
+// negotiated reports whether transport has pipeName down as speaking
+// HTTP/2.
+func negotiated(transport *Transport, pipeName string) bool {
+	transport.mutex.Lock()
+	defer transport.mutex.Unlock()
+	return transport.h2Pipes[pipeName]
+}
+
+func TestNegotiatedHTTP2FallsBack(t *testing.T) {
+	var advertise atomic.Bool
+	advertise.Store(true)
+	s := startTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		// The server only speaks HTTP/1.1, but claims otherwise until it
+		// is "restarted" without EnableH2C.
+		if advertise.Load() {
+			w.Header().Set(HeaderMultiplex, multiplexH2C)
+		}
+		io.WriteString(w, "ok")
+	})
+	transport := &Transport{NegotiateHTTP2: true}
+	defer transport.Close()
+	transport.RegisterTargetService("svc", s.path)
+	client := &http.Client{Transport: transport}
+
+	if _, err := getBody(client, "http+npipe://svc/"); err != nil {
+		t.Fatal(err)
+	}
+	if !negotiated(transport, s.path) {
+		t.Fatal("HTTP/2 not negotiated from the response header")
+	}
+	advertise.Store(false)
+	body, err := getBody(client, "http+npipe://svc/")
+	if err != nil {
+		t.Fatalf("request after the server stopped speaking HTTP/2: %v", err)
+	}
+	if body != "ok" {
+		t.Fatalf("got body %q, want %q", body, "ok")
+	}
+	if negotiated(transport, s.path) {
+		t.Fatal("pipe still down as speaking HTTP/2 after a failed preface")
+	}
+}
+
+func TestRemapForgetsNegotiatedHTTP2(t *testing.T) {
+	advertising := func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(HeaderMultiplex, multiplexH2C)
+	}
+	a := startTestServer(t, advertising)
+	b := startTestServer(t, advertising)
+	transport := &Transport{NegotiateHTTP2: true}
+	defer transport.Close()
+	transport.RegisterTargetService("svc", a.path)
+	transport.noteMultiplex(a.path, &http.Response{Header: http.Header{HeaderMultiplex: {multiplexH2C}}})
+
+	transport.Registry().Replace("svc", b.path)
+	if negotiated(transport, a.path) {
+		t.Fatal("pipe no service is mapped to still down as speaking HTTP/2")
+	}
+}
@@ -0,0 +1,84 @@
+/*
+   Copyright 2018 Docker, Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package httpnpipe
+
+import (
+	"net/http"
+	"sync"
+)
+
+// ServiceMux is an http.Handler that dispatches each request by the
+// service it was sent to, as named by the Host header, which a Transport
+// sets from the URL. It lets one server process offer several APIs, on one
+// pipe or on many: give it to a Server, and call Serve with a listener for
+// each pipe.
+//
+// The zero value is an empty ServiceMux ready to use.
+type ServiceMux struct {
+	mutex    sync.RWMutex
+	handlers map[string]http.Handler
+}
+
+// NewServiceMux returns an empty ServiceMux.
+func NewServiceMux() *ServiceMux {
+	return &ServiceMux{}
+}
+
+// Handle registers handler for requests to service. A handler for the
+// empty service gets the requests no other handler matches. Like
+// http.ServeMux.Handle, it panics if service already has a handler.
+func (mux *ServiceMux) Handle(service string, handler http.Handler) {
+	if handler == nil {
+		panic("http+npipe: nil handler for service " + service)
+	}
+	mux.mutex.Lock()
+	defer mux.mutex.Unlock()
+	if _, exists := mux.handlers[service]; exists {
+		panic("http+npipe: multiple handlers for service " + service)
+	}
+	if mux.handlers == nil {
+		mux.handlers = make(map[string]http.Handler)
+	}
+	mux.handlers[service] = handler
+}
+
+// HandleFunc registers handler for requests to service, as Handle does.
+func (mux *ServiceMux) HandleFunc(service string, handler func(http.ResponseWriter, *http.Request)) {
+	mux.Handle(service, http.HandlerFunc(handler))
+}
+
+// Handler returns the handler for the service of r, or nil if there is
+// none.
+func (mux *ServiceMux) Handler(r *http.Request) http.Handler {
+	mux.mutex.RLock()
+	defer mux.mutex.RUnlock()
+	if handler, ok := mux.handlers[r.Host]; ok {
+		return handler
+	}
+	return mux.handlers[""]
+}
+
+// ServeHTTP dispatches r to the handler for its service, answering 404 Not
+// Found if there is none.
+func (mux *ServiceMux) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	handler := mux.Handler(r)
+	if handler == nil {
+		http.Error(w, "unknown service "+r.Host, http.StatusNotFound)
+		return
+	}
+	handler.ServeHTTP(w, r)
+}
@@ -0,0 +1,260 @@
+/*
+   Copyright 2018 Docker, Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package httpnpipe
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The protocol negotiation of WithProtocolNegotiation, DialProtocol and
+// Server.NegotiateProtocols takes one line each way, before anything else
+// goes over the connection. The client offers the IDs of the protocols it
+// can speak, most preferred first:
+//
+//	NPIPE-PROTO http/1.1,h2c\n
+//
+// and the server answers with the one it picked, or with nothing if it
+// serves none of them, in which case it closes the connection:
+//
+//	NPIPE-PROTO h2c\n
+const protocolPreamble = "NPIPE-PROTO "
+
+// maxPreambleSize bounds a line of the protocol negotiation.
+const maxPreambleSize = 1024
+
+// The IDs of the protocols the transport negotiates for HTTP: HTTP/1.1,
+// and HTTP/2 in cleartext or over TLS.
+const (
+	protocolHTTP1 = "http/1.1"
+	protocolH2C   = "h2c"
+	protocolH2    = "h2"
+)
+
+// WithProtocolNegotiation has the Transport open each connection to a
+// service with the protocol negotiation of a Server with
+// NegotiateProtocols set, settling on HTTP/1.1, or on HTTP/2 for
+// EnableHTTP2 and NegotiateHTTP2.
+func WithProtocolNegotiation() RegisterOption {
+	return func(r *registration) {
+		r.negotiated = true
+	}
+}
+
+// DialProtocol connects to serviceName as DialService does, and settles
+// with a Server with NegotiateProtocols set on one of protocols, given in
+// order of preference, to speak over the connection. It returns the
+// connection and the protocol picked. If the server serves none of them,
+// it returns an error wrapping ErrNoProtocol. The negotiation runs within
+// DialTimeout.
+func (transport *Transport) DialProtocol(ctx context.Context, serviceName string, protocols ...string) (net.Conn, string, error) {
+	c, err := transport.DialService(ctx, serviceName)
+	if err != nil {
+		return nil, "", err
+	}
+	var protocol string
+	err = transport.withDialDeadline(ctx, c, func() error {
+		protocol, err = offerProtocols(c, protocols...)
+		return err
+	})
+	if err != nil {
+		c.Close()
+		return nil, "", err
+	}
+	return c, protocol, nil
+}
+
+// withDialDeadline runs f, a handshake over c, within DialTimeout and the
+// lifetime of ctx.
+func (transport *Transport) withDialDeadline(ctx context.Context, c net.Conn, f func() error) error {
+	c.SetDeadline(deadline(ctx, transport.timeouts(ctx).DialTimeout))
+	stop := context.AfterFunc(ctx, func() { c.SetDeadline(aLongTimeAgo) })
+	err := f()
+	if !stop() && err != nil {
+		err = ctx.Err()
+	}
+	c.SetDeadline(time.Time{})
+	return err
+}
+
+// offerProtocols runs the client side of the protocol negotiation over c.
+func offerProtocols(c net.Conn, protocols ...string) (string, error) {
+	if len(protocols) == 0 {
+		return "", fmt.Errorf("%w: none offered", ErrNoProtocol)
+	}
+	for _, protocol := range protocols {
+		if protocol == "" || strings.ContainsAny(protocol, ", \r\n") {
+			return "", fmt.Errorf("%w: bad protocol ID %q", ErrNoProtocol, protocol)
+		}
+	}
+	if _, err := io.WriteString(c, protocolPreamble+strings.Join(protocols, ",")+"\n"); err != nil {
+		return "", err
+	}
+	line, err := readPreamble(c)
+	if err != nil {
+		return "", err
+	}
+	picked, ok := strings.CutPrefix(line, protocolPreamble)
+	if !ok {
+		return "", fmt.Errorf("%w: bad answer %q", ErrNoProtocol, line)
+	}
+	for _, protocol := range protocols {
+		if picked == protocol {
+			return picked, nil
+		}
+	}
+	return "", fmt.Errorf("%w: offered %s", ErrNoProtocol, strings.Join(protocols, ", "))
+}
+
+// readPreamble reads a line of the protocol negotiation from c, without
+// its newline. It reads a byte at a time, so that nothing meant for the
+// protocol agreed on is read with it.
+func readPreamble(c net.Conn) (string, error) {
+	var line []byte
+	b := make([]byte, 1)
+	for len(line) < maxPreambleSize {
+		if _, err := io.ReadFull(c, b); err != nil {
+			return "", err
+		}
+		if b[0] == '\n' {
+			return string(line), nil
+		}
+		line = append(line, b[0])
+	}
+	return "", fmt.Errorf("%w: negotiation line too long", ErrNoProtocol)
+}
+
+// serveProtocol reports how srv serves protocol: as HTTP, or with one of
+// its ProtocolHandlers.
+func (srv *Server) serveProtocol(protocol string) (isHTTP bool, handler func(net.Conn)) {
+	switch protocol {
+	case protocolHTTP1:
+		return true, nil
+	case protocolH2C:
+		return srv.EnableH2C && srv.TLSConfig == nil, nil
+	case protocolH2:
+		return srv.TLSConfig != nil, nil
+	}
+	return false, srv.ProtocolHandlers[protocol]
+}
+
+// negotiateListener runs the server side of the protocol negotiation on the
+// connections accepted from a listener, each in a goroutine of its own so
+// that a slow client holds up no other. Those that settle on HTTP are
+// returned from Accept; the others go to their ProtocolHandlers.
+type negotiateListener struct {
+	net.Listener
+	srv       *Server
+	accepted  chan acceptResult
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+type acceptResult struct {
+	conn net.Conn
+	err  error
+}
+
+func newNegotiateListener(l net.Listener, srv *Server) *negotiateListener {
+	nl := &negotiateListener{
+		Listener: l,
+		srv:      srv,
+		accepted: make(chan acceptResult),
+		done:     make(chan struct{}),
+	}
+	go nl.acceptLoop()
+	return nl
+}
+
+func (l *negotiateListener) acceptLoop() {
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil {
+			select {
+			case l.accepted <- acceptResult{err: err}:
+			case <-l.done:
+				return
+			}
+			if ne, ok := err.(interface{ Temporary() bool }); ok && ne.Temporary() {
+				continue
+			}
+			return
+		}
+		go l.negotiate(c)
+	}
+}
+
+func (l *negotiateListener) negotiate(c net.Conn) {
+	if timeout := serverTimeout(l.srv.ReadHeaderTimeout, DefaultServerReadHeaderTimeout); timeout > 0 {
+		c.SetDeadline(time.Now().Add(timeout))
+	}
+	isHTTP, handler, err := l.pick(c)
+	if err != nil {
+		c.Close()
+		return
+	}
+	c.SetDeadline(time.Time{})
+	if !isHTTP {
+		handler(c)
+		return
+	}
+	select {
+	case l.accepted <- acceptResult{conn: c}:
+	case <-l.done:
+		c.Close()
+	}
+}
+
+// pick reads the protocols c offers and answers with the first srv serves,
+// reporting how it is served.
+func (l *negotiateListener) pick(c net.Conn) (isHTTP bool, handler func(net.Conn), err error) {
+	line, err := readPreamble(c)
+	if err != nil {
+		return false, nil, err
+	}
+	offered, ok := strings.CutPrefix(line, protocolPreamble)
+	if !ok {
+		return false, nil, fmt.Errorf("%w: bad offer %q", ErrNoProtocol, line)
+	}
+	for _, protocol := range strings.Split(offered, ",") {
+		if isHTTP, handler = l.srv.serveProtocol(protocol); isHTTP || handler != nil {
+			_, err = io.WriteString(c, protocolPreamble+protocol+"\n")
+			return isHTTP, handler, err
+		}
+	}
+	io.WriteString(c, protocolPreamble+"\n")
+	return false, nil, fmt.Errorf("%w: offered %s", ErrNoProtocol, offered)
+}
+
+func (l *negotiateListener) Accept() (net.Conn, error) {
+	select {
+	case r := <-l.accepted:
+		return r.conn, r.err
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *negotiateListener) Close() error {
+	l.closeOnce.Do(func() { close(l.done) })
+	return l.Listener.Close()
+}
@@ -0,0 +1,47 @@
+/*
+   Copyright 2018 Docker, Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package httpnpipe
+
+import (
+	"net/http"
+	"strconv"
+)
+
+// The headers a Server with InjectPeerHeaders set adds to each request.
+const (
+	// HeaderClientPID holds the process ID of the client.
+	HeaderClientPID = "X-Pipe-Client-Pid"
+	// HeaderClientUser holds the SID of the user the client runs as.
+	HeaderClientUser = "X-Pipe-Client-User"
+)
+
+// peerHeaderHandler sets the peer headers on each request to handler from
+// the identity of the client that sent it, after removing any the client
+// sent itself so that they cannot be forged.
+func peerHeaderHandler(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.Header.Del(HeaderClientPID)
+		r.Header.Del(HeaderClientUser)
+		if client, ok := ClientIdentityFromContext(r.Context()); ok {
+			r.Header.Set(HeaderClientPID, strconv.FormatUint(uint64(client.ProcessID), 10))
+			if client.SID != "" {
+				r.Header.Set(HeaderClientUser, client.SID)
+			}
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
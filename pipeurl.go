@@ -0,0 +1,57 @@
+/*
+   Copyright 2018 Docker, Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package httpnpipe
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// LocalPipeHost is the host of URLs that name a pipe of the local machine
+// in their path, for a Transport with AllowPipeURLs set:
+//
+//	http+npipe://./pipe/docker_engine/v1.41/containers/json
+//
+// goes to \\.\pipe\docker_engine for /v1.41/containers/json.
+const LocalPipeHost = "."
+
+// pipeURLRequest splits the pipe named by the path of req from the rest,
+// and returns a copy of req for the rest of the path, with the pipe.
+func pipeURLRequest(req *http.Request) (*http.Request, string, error) {
+	rest, ok := strings.CutPrefix(req.URL.EscapedPath(), "/pipe/")
+	if !ok {
+		return nil, "", fmt.Errorf("%w: %q", ErrNoPipePath, req.URL.Path)
+	}
+	name, rawPath, _ := strings.Cut(rest, "/")
+	name, err := url.PathUnescape(name)
+	if err != nil || name == "" || strings.ContainsAny(name, `/\`) {
+		return nil, "", fmt.Errorf("%w: %q", ErrNoPipePath, req.URL.Path)
+	}
+	rawPath = "/" + rawPath
+	path, err := url.PathUnescape(rawPath)
+	if err != nil {
+		return nil, "", fmt.Errorf("%w: %v", ErrInvalidRequest, err)
+	}
+
+	u := *req.URL
+	u.Path, u.RawPath = path, rawPath
+	out := cloneRequest(req)
+	out.URL = &u
+	return out, PipeDir + name, nil
+}
@@ -0,0 +1,85 @@
+/*
+   Copyright 2018 Docker, Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package httpnpipe
+
+import (
+	"fmt"
+	"net"
+)
+
+// AllowClients returns an AcceptPolicy that lets in only the clients whose
+// user, or one of whose groups, is among sids, such as S-1-5-18 for
+// LocalSystem or S-1-5-32-544 for Administrators. Clients whose identity
+// is unknown are kept out.
+func AllowClients(sids ...string) func(client ClientIdentity) error {
+	allowed := make(map[string]bool, len(sids))
+	for _, sid := range sids {
+		allowed[sid] = true
+	}
+	return func(client ClientIdentity) error {
+		if client.SID == "" {
+			return fmt.Errorf("%w: unknown client, process %d", ErrClientNotAllowed, client.ProcessID)
+		}
+		if allowed[client.SID] {
+			return nil
+		}
+		for _, group := range client.Groups {
+			if allowed[group] {
+				return nil
+			}
+		}
+		return fmt.Errorf("%w: %s, process %d", ErrClientNotAllowed, client.SID, client.ProcessID)
+	}
+}
+
+// policyListener applies the AcceptPolicy of a Server to the connections
+// accepted from a listener, closing those it rejects.
+type policyListener struct {
+	net.Listener
+	srv *Server
+}
+
+func (l *policyListener) Accept() (net.Conn, error) {
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		client, known := connIdentity(c)
+		if err := l.srv.AcceptPolicy(client); err != nil {
+			c.Close()
+			if l.srv.OnRejectedClient != nil {
+				l.srv.OnRejectedClient(client, err)
+			}
+			continue
+		}
+		return &policyConn{Conn: c, client: client, known: known}, nil
+	}
+}
+
+// policyConn is a connection let in by an AcceptPolicy, along with the
+// identity of its client.
+type policyConn struct {
+	net.Conn
+	client ClientIdentity
+	known  bool
+}
+
+// NetConn returns the connection c wraps.
+func (c *policyConn) NetConn() net.Conn {
+	return c.Conn
+}
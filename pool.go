@@ -0,0 +1,648 @@
+/*
+   Copyright 2018 Docker, Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package httpnpipe
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"math"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultMaxIdleConnsPerService is the default value of Transport's
+// MaxIdleConnsPerService.
+const DefaultMaxIdleConnsPerService = 2
+
+const defaultMaxResponseHeaderBytes = 10 << 20
+
+// persistConn is a pipe connection that can carry several sequential
+// requests to the same service.
+type persistConn struct {
+	transport *Transport
+	service   string
+	pipeName  string
+	secure    bool // whether conn is TLS, for https+npipe
+	framed    bool // whether requests go out in one message, for WithMessageFraming
+	conn      net.Conn
+	br        *bufio.Reader // reads from persistConn itself, within readLimit
+	reused    bool
+
+	createdAt time.Time
+	idleAt    time.Time
+	idleTimer *time.Timer // closes the connection when it expires in the pool
+
+	readLimit int64
+	captured  *bytes.Buffer // raw bytes read, for StrictParsing
+	closeOnce sync.Once
+
+	// hold keeps the connection out of the pool once a response is done
+	// with, for an authentication handshake to go on over it; held is set
+	// when that happens. Both are guarded by transport.mutex once the
+	// request is under way.
+	hold bool
+	held bool
+}
+
+// startCapture begins recording the raw bytes of the next response,
+// including any already buffered.
+func (pc *persistConn) startCapture() {
+	buffered, _ := pc.br.Peek(pc.br.Buffered())
+	pc.captured = bytes.NewBuffer(append([]byte(nil), buffered...))
+}
+
+// stopCapture ends the recording and returns what was recorded, if
+// anything.
+func (pc *persistConn) stopCapture() []byte {
+	if pc.captured == nil {
+		return nil
+	}
+	raw := pc.captured.Bytes()
+	pc.captured = nil
+	return raw
+}
+
+// close closes the connection and gives up its place under
+// MaxConnsPerService. It must not be called with transport.mutex held; use
+// closeLocked then.
+func (pc *persistConn) close() {
+	pc.closeOnce.Do(func() {
+		pc.conn.Close()
+		pc.transport.mutex.Lock()
+		pc.transport.forgetConnLocked(pc.service)
+		pc.transport.mutex.Unlock()
+	})
+}
+
+// closeLocked is close for callers holding transport.mutex.
+func (pc *persistConn) closeLocked() {
+	pc.closeOnce.Do(func() {
+		pc.conn.Close()
+		pc.transport.forgetConnLocked(pc.service)
+	})
+}
+
+// Read reads from the connection, failing once readLimit bytes have been
+// read.
+func (pc *persistConn) Read(p []byte) (int, error) {
+	if pc.readLimit <= 0 {
+		return 0, ErrResponseHeaderTooLarge
+	}
+	if int64(len(p)) > pc.readLimit {
+		p = p[:pc.readLimit]
+	}
+	n, err := pc.conn.Read(p)
+	pc.readLimit -= int64(n)
+	if pc.captured != nil {
+		pc.captured.Write(p[:n])
+	}
+	return n, err
+}
+
+func (pc *persistConn) setReadLimit(n int64) {
+	pc.readLimit = n
+}
+
+func (transport *Transport) maxIdleConnsPerService() int {
+	if n := transport.MaxIdleConnsPerService; n != 0 {
+		return n
+	}
+	return DefaultMaxIdleConnsPerService
+}
+
+// keepAlive reports whether the connection that carried req and resp may
+// carry another request once the response body has been read.
+// http.ReadResponse already folds the server's Connection header, HTTP/1.0
+// keep-alive rules and close-delimited bodies into resp.Close.
+func keepAlive(req *http.Request, resp *http.Response) bool {
+	if req.Close || resp.Close {
+		return false
+	}
+	return !hasToken(req.Header, "Connection", "close") &&
+		!hasToken(resp.Header, "Connection", "close")
+}
+
+// hasToken reports whether the comma-separated header key contains token,
+// ignoring case.
+func hasToken(header http.Header, key, token string) bool {
+	for _, v := range header[http.CanonicalHeaderKey(key)] {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (transport *Transport) maxResponseHeaderBytes() int64 {
+	if n := transport.MaxResponseHeaderBytes; n != 0 {
+		return n
+	}
+	return defaultMaxResponseHeaderBytes
+}
+
+// getConn returns an idle connection to service if there is one and reuse
+// is set, and dials pipeName otherwise. If service already has
+// MaxConnsPerService connections, it waits for one of them to be returned
+// to the pool or closed; without reuse, an idle one is closed to make room
+// instead, as net/http does, since returning to the pool would not help.
+func (transport *Transport) getConn(ctx context.Context, service, pipeName string, secure, reuse bool) (*persistConn, error) {
+	for {
+		transport.mutex.Lock()
+		if transport.closed {
+			transport.mutex.Unlock()
+			return nil, ErrTransportClosed
+		}
+		if reuse {
+			if pc := transport.getIdleConnLocked(service, pipeName, secure); pc != nil {
+				transport.mutex.Unlock()
+				return pc, nil
+			}
+		}
+		max := transport.MaxConnsPerService
+		if !reuse && max > 0 && transport.conns[service] >= max {
+			transport.closeOldestIdleLocked(service)
+		}
+		if max <= 0 || transport.conns[service] < max {
+			if transport.conns == nil {
+				transport.conns = make(map[string]int)
+			}
+			transport.conns[service]++
+			transport.mutex.Unlock()
+
+			pc, err := transport.dialConn(ctx, service, pipeName, secure)
+			if err != nil {
+				transport.mutex.Lock()
+				transport.forgetConnLocked(service)
+				transport.mutex.Unlock()
+			}
+			return pc, err
+		}
+		if noWait, _ := ctx.Value(noWaitKey{}).(bool); noWait {
+			transport.mutex.Unlock()
+			return nil, errNoConnFree
+		}
+		wait := make(chan struct{}, 1)
+		if transport.connWaiters == nil {
+			transport.connWaiters = make(map[string][]chan struct{})
+		}
+		transport.connWaiters[service] = append(transport.connWaiters[service], wait)
+		transport.mutex.Unlock()
+
+		select {
+		case <-wait:
+		case <-ctx.Done():
+			transport.mutex.Lock()
+			transport.cancelWaitLocked(service, wait)
+			transport.mutex.Unlock()
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// noWaitKey marks a context for which getConn fails with errNoConnFree
+// rather than wait for a connection to come free.
+type noWaitKey struct{}
+
+var errNoConnFree = errors.New("http+npipe: no connection free")
+
+// forgetConnLocked accounts for a connection to service having been closed,
+// and wakes up a request waiting for the place it held.
+func (transport *Transport) forgetConnLocked(service string) {
+	if transport.conns[service]--; transport.conns[service] <= 0 {
+		delete(transport.conns, service)
+	}
+	transport.wakeWaiterLocked(service)
+}
+
+// wakeWaiterLocked tells the longest waiting request for a connection to
+// service to try again.
+func (transport *Transport) wakeWaiterLocked(service string) {
+	waiters := transport.connWaiters[service]
+	if len(waiters) == 0 {
+		return
+	}
+	waiters[0] <- struct{}{}
+	if len(waiters) == 1 {
+		delete(transport.connWaiters, service)
+	} else {
+		transport.connWaiters[service] = waiters[1:]
+	}
+}
+
+// cancelWaitLocked removes wait from the requests waiting on service. If it
+// has already been woken up, the wake-up goes to the next one instead.
+func (transport *Transport) cancelWaitLocked(service string, wait chan struct{}) {
+	waiters := transport.connWaiters[service]
+	for i, w := range waiters {
+		if w == wait {
+			transport.connWaiters[service] = append(waiters[:i:i], waiters[i+1:]...)
+			if len(transport.connWaiters[service]) == 0 {
+				delete(transport.connWaiters, service)
+			}
+			return
+		}
+	}
+	transport.wakeWaiterLocked(service)
+}
+
+// dialConn returns a new connection to service.
+func (transport *Transport) dialConn(ctx context.Context, service, pipeName string, secure bool) (*persistConn, error) {
+	c, err := transport.dialWrapped(ctx, service, pipeName, protocolHTTP1)
+	if err != nil {
+		return nil, err
+	}
+	if secure {
+		if c, err = transport.handshake(ctx, c, service, pipeName, "http/1.1"); err != nil {
+			return nil, err
+		}
+	}
+	pc := &persistConn{
+		transport: transport,
+		service:   service,
+		pipeName:  pipeName,
+		secure:    secure,
+		framed:    transport.routes().framed[service],
+		conn:      c,
+		createdAt: time.Now(),
+		readLimit: math.MaxInt64,
+	}
+	pc.br = bufio.NewReaderSize(pc, bufferSize(transport.ReadBufferSize))
+	return pc, nil
+}
+
+// dialRaw connects to pipeName for service, or through the dialer
+// registered for it.
+func (transport *Transport) dialRaw(ctx context.Context, service, pipeName string) (net.Conn, error) {
+	timeout := transport.timeouts(ctx).DialTimeout
+	var c net.Conn
+	var err error
+	if d := transport.routes().dialerFor(service, pipeName); d != nil {
+		c, err = dialService(ctx, d, max(timeout, 0))
+	} else if !isPipeName(pipeName) {
+		c, err = dialUnix(ctx, pipeName, max(timeout, 0))
+	} else if transport.usesWSLRelay() {
+		c, err = transport.dialWSLRelay(ctx, pipeName)
+	} else if host, remote := pipeHost(pipeName); remote {
+		c, err = transport.dialRemotePipe(ctx, service, host, pipeName, timeout)
+	} else {
+		c, err = dialPipe(ctx, pipeName, max(timeout, 0))
+	}
+	if err != nil {
+		return nil, &DialError{Service: service, Pipe: pipeName, Err: err}
+	}
+	return c, nil
+}
+
+// dialWrapped is dialRaw followed by what the service needs before
+// protocol speaks over the connection: the framing of WithMessageFraming,
+// the negotiation of WithProtocolNegotiation, and the Transport's
+// ConnWrapper.
+func (transport *Transport) dialWrapped(ctx context.Context, service, pipeName, protocol string) (net.Conn, error) {
+	c, err := transport.dialRaw(ctx, service, pipeName)
+	if err != nil {
+		return nil, err
+	}
+	r := transport.routes()
+	if r.framed[service] {
+		c = &framedConn{Conn: c}
+	}
+	if !r.negotiated[service] && transport.ConnWrapper == nil {
+		return c, nil
+	}
+	wrapped := c
+	err = transport.withDialDeadline(ctx, c, func() error {
+		if r.negotiated[service] {
+			if _, err := offerProtocols(c, protocol); err != nil {
+				return err
+			}
+		}
+		if transport.ConnWrapper == nil {
+			return nil
+		}
+		var err error
+		if wrapped, err = transport.ConnWrapper(c, service); err == nil && wrapped == nil {
+			err = errors.New("ConnWrapper returned no connection")
+		}
+		return err
+	})
+	if err != nil {
+		c.Close()
+		return nil, &DialError{Service: service, Pipe: pipeName, Err: err}
+	}
+	return wrapped, nil
+}
+
+// getIdleConnLocked pops the most recently used idle connection to service,
+// discarding any that have expired or that lead to some other pipe than
+// pipeName.
+func (transport *Transport) getIdleConnLocked(service, pipeName string, secure bool) *persistConn {
+	idle := transport.idleConns[service]
+	for i := len(idle) - 1; i >= 0; i-- {
+		pc := idle[i]
+		if pc.secure != secure {
+			// Kept for requests of the other scheme.
+			continue
+		}
+		idle = append(idle[:i], idle[i+1:]...)
+		if pc.idleTimer != nil && !pc.idleTimer.Stop() {
+			// Expired already, and the timer is closing it.
+			continue
+		}
+		if transport.idleExpiry(pc) < 0 || pc.pipeName != pipeName {
+			pc.closeLocked()
+			continue
+		}
+		transport.setIdleConns(service, idle)
+		pc.reused = true
+		return pc
+	}
+	transport.setIdleConns(service, idle)
+	return nil
+}
+
+// putIdleConn returns pc to the pool, or closes it if the pool for its
+// service is already full, pc has outlived MaxConnLifetime, or the service
+// is no longer mapped to the pipe pc is connected to.
+func (transport *Transport) putIdleConn(pc *persistConn) {
+	transport.mutex.Lock()
+	defer transport.mutex.Unlock()
+	if pc.hold && !transport.closed {
+		pc.conn.SetDeadline(time.Time{})
+		pc.held = true
+		return
+	}
+	idle := transport.idleConns[pc.service]
+	if transport.closed || !transport.currentLocked(pc) ||
+		len(idle) >= transport.maxIdleConnsPerService() {
+		pc.closeLocked()
+		return
+	}
+	// Deadlines set for the previous request must not carry over.
+	pc.conn.SetDeadline(time.Time{})
+	pc.idleAt = time.Now()
+	expiry := transport.idleExpiry(pc)
+	if expiry < 0 {
+		pc.closeLocked()
+		return
+	}
+	pc.idleTimer = nil
+	if expiry > 0 {
+		pc.idleTimer = time.AfterFunc(expiry, func() { transport.expireIdleConn(pc) })
+	}
+	transport.setIdleConns(pc.service, append(idle, pc))
+	transport.wakeWaiterLocked(pc.service)
+}
+
+// currentLocked reports whether pc's service is still mapped to the pipe
+// pc is connected to. Mappings from a Resolver are only known per request,
+// so those connections are checked when they are taken from the pool
+// instead.
+func (transport *Transport) currentLocked(pc *persistConn) bool {
+	if transport.Resolver != nil {
+		return true
+	}
+	return transport.routes().leadsTo(pc.service, pc.pipeName)
+}
+
+// idleExpiry returns how much longer idle pc may stay in the pool, going by
+// IdleConnTimeout and MaxConnLifetime: zero if there is no limit, and a
+// negative duration if it should go now.
+func (transport *Transport) idleExpiry(pc *persistConn) time.Duration {
+	var expiry time.Time
+	if transport.IdleConnTimeout > 0 {
+		expiry = pc.idleAt.Add(transport.IdleConnTimeout)
+	}
+	if transport.MaxConnLifetime > 0 {
+		expiry = earliest(expiry, pc.createdAt.Add(transport.MaxConnLifetime))
+	}
+	if expiry.IsZero() {
+		return 0
+	}
+	if d := time.Until(expiry); d > 0 {
+		return d
+	}
+	return -1
+}
+
+// expireIdleConn removes pc from the pool and closes it, once it has been
+// idle for too long.
+func (transport *Transport) expireIdleConn(pc *persistConn) {
+	transport.mutex.Lock()
+	defer transport.mutex.Unlock()
+	idle := transport.idleConns[pc.service]
+	for i, other := range idle {
+		if other == pc {
+			transport.setIdleConns(pc.service, append(idle[:i:i], idle[i+1:]...))
+			break
+		}
+	}
+	pc.closeLocked()
+}
+
+// takeHeldConn takes back pc, kept out of the pool by pc.hold when its
+// last response was done with, for a request that has to go over that very
+// connection. It reports false if pc was closed instead.
+func (transport *Transport) takeHeldConn(pc *persistConn) bool {
+	transport.mutex.Lock()
+	defer transport.mutex.Unlock()
+	held := pc.held
+	pc.held = false
+	if held {
+		pc.reused = true
+	}
+	return held
+}
+
+// unholdConn lets pc return to the pool once its response is done with,
+// and returns it there now if it is held already.
+func (transport *Transport) unholdConn(pc *persistConn) {
+	transport.mutex.Lock()
+	held := pc.held
+	pc.hold, pc.held = false, false
+	transport.mutex.Unlock()
+	if held {
+		transport.putIdleConn(pc)
+	}
+}
+
+// staleConnError marks a request failure that can be put down to a pooled
+// connection having been closed by the server while it sat idle: the
+// request could not be written, or the connection ended before any of the
+// response came back. The server cannot have acted on such a request.
+type staleConnError struct {
+	err error
+}
+
+func (e *staleConnError) Error() string {
+	return e.err.Error()
+}
+
+// staleError wraps err in a staleConnError if pc came from the pool.
+func (pc *persistConn) staleError(err error) error {
+	if !pc.reused {
+		return err
+	}
+	return &staleConnError{err}
+}
+
+// isReplayable reports whether req may be sent a second time, by the
+// same rules as net/http: its body can be recreated and either its method
+// is idempotent or it carries an idempotency key.
+func isReplayable(req *http.Request) bool {
+	if hasBody(req) && req.GetBody == nil {
+		return false
+	}
+	switch req.Method {
+	case "", http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return true
+	}
+	_, ok := req.Header["Idempotency-Key"]
+	_, xok := req.Header["X-Idempotency-Key"]
+	return ok || xok
+}
+
+// rewindBody returns a copy of req with a fresh body, ready to be sent
+// again.
+func rewindBody(req *http.Request) (*http.Request, error) {
+	if !hasBody(req) {
+		return req, nil
+	}
+	body, err := req.GetBody()
+	if err != nil {
+		return nil, err
+	}
+	r := cloneRequest(req)
+	r.Body = body
+	return r, nil
+}
+
+// CloseIdleConnections closes any connections that are sitting idle in the
+// pool. Connections in use by a request are left alone.
+func (transport *Transport) CloseIdleConnections() {
+	transport.mutex.Lock()
+	idleConns := transport.idleConns
+	transport.idleConns = nil
+	h2 := transport.h2
+	transport.mutex.Unlock()
+	if h2 != nil {
+		h2.CloseIdleConnections()
+	}
+	for _, idle := range idleConns {
+		for _, pc := range idle {
+			if pc.idleTimer != nil {
+				pc.idleTimer.Stop()
+			}
+			pc.close()
+		}
+	}
+}
+
+// closeOldestIdleLocked closes the idle connection to service that has been
+// idle the longest, if there is one.
+func (transport *Transport) closeOldestIdleLocked(service string) {
+	idle := transport.idleConns[service]
+	if len(idle) == 0 {
+		return
+	}
+	pc := idle[0]
+	transport.setIdleConns(service, idle[1:])
+	if pc.idleTimer != nil {
+		pc.idleTimer.Stop()
+	}
+	pc.closeLocked()
+}
+
+// closeIdleConnsLocked closes the idle connections to service.
+func (transport *Transport) closeIdleConnsLocked(service string) {
+	for _, pc := range transport.idleConns[service] {
+		if pc.idleTimer != nil {
+			pc.idleTimer.Stop()
+		}
+		pc.closeLocked()
+	}
+	delete(transport.idleConns, service)
+}
+
+// Close closes all idle connections and stops the transport from issuing
+// new requests. Connections still in use are closed as soon as their
+// response body is done with instead of returning to the pool.
+func (transport *Transport) Close() error {
+	transport.mutex.Lock()
+	transport.closed = true
+	// Requests waiting for a connection find out the transport is closed.
+	for service := range transport.connWaiters {
+		for len(transport.connWaiters[service]) > 0 {
+			transport.wakeWaiterLocked(service)
+		}
+	}
+	transport.mutex.Unlock()
+	if reg := transport.registry.Load(); reg != nil {
+		reg.detach(transport)
+	}
+	transport.CloseIdleConnections()
+	return nil
+}
+
+// pruneIdleConns closes the idle connections whose service has since been
+// mapped to another pipe, or unregistered.
+func (transport *Transport) pruneIdleConns() {
+	transport.mutex.Lock()
+	defer transport.mutex.Unlock()
+	if transport.Resolver != nil {
+		return
+	}
+	if transport.h2 != nil {
+		// HTTP/2 connections cannot be told apart, so all the idle
+		// ones go, and are dialed again as the mappings now say.
+		transport.h2.CloseIdleConnections()
+	}
+	r := transport.routes()
+	transport.forgetMultiplexLocked(r)
+	for service, idle := range transport.idleConns {
+		kept := idle[:0]
+		for _, pc := range idle {
+			if r.leadsTo(service, pc.pipeName) {
+				kept = append(kept, pc)
+				continue
+			}
+			if pc.idleTimer != nil {
+				pc.idleTimer.Stop()
+			}
+			pc.closeLocked()
+		}
+		transport.setIdleConns(service, kept)
+	}
+}
+
+// setIdleConns must be called with transport.mutex held.
+func (transport *Transport) setIdleConns(service string, idle []*persistConn) {
+	if len(idle) == 0 {
+		delete(transport.idleConns, service)
+		return
+	}
+	if transport.idleConns == nil {
+		transport.idleConns = make(map[string][]*persistConn)
+	}
+	transport.idleConns[service] = idle
+}
@@ -0,0 +1,62 @@
+/*
+   Copyright 2018 Docker, Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package httpnpipe
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestFreshConnAtLimitClosesIdle(t *testing.T) {
+	pipes := &fakePipes{serve: serveReplies(func(*http.Request) string {
+		return "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok"
+	})}
+	transport := &Transport{MaxConnsPerService: 1}
+	defer transport.Close()
+	if err := transport.RegisterTargetDialer("svc", pipes.dial); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := getBody(&http.Client{Transport: transport}, "http+npipe://svc/"); err != nil {
+		t.Fatal(err)
+	}
+	if n := idleConns(transport, "svc"); n != 1 {
+		t.Fatalf("%d idle connections, want 1", n)
+	}
+
+	// As the retry of a request that found its pooled connection stale
+	// does, ask for a fresh connection while the only place is held by an
+	// idle one.
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	pipeName, _ := transport.Registry().Lookup("svc")
+	pc, err := transport.getConn(ctx, "svc", pipeName, false, false)
+	if err != nil {
+		t.Fatalf("getConn without reuse: %v", err)
+	}
+	defer pc.close()
+	if n := idleConns(transport, "svc"); n != 0 {
+		t.Errorf("%d idle connections left, want 0", n)
+	}
+	if n := pipes.dialed.Load(); n != 2 {
+		t.Errorf("%d connections dialed, want 2", n)
+	}
+	if n := pipes.leaked(); n != 1 {
+		t.Errorf("%d connections open, want just the fresh one", n)
+	}
+}
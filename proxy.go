@@ -0,0 +1,58 @@
+/*
+   Copyright 2018 Docker, Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package httpnpipe
+
+import (
+	"net/http/httputil"
+	"net/url"
+)
+
+// NewPipeReverseProxy returns a reverse proxy that forwards the requests
+// it is given, typically by an HTTP server listening on TCP, to service
+// through transport, so that a daemon listening only on a pipe can be
+// reached over the network. A nil transport means DefaultTransport.
+// Protocol upgrades such as WebSocket are passed through. The proxy sets
+// the X-Forwarded headers, and can be customized further before use.
+func NewPipeReverseProxy(transport *Transport, service string) *httputil.ReverseProxy {
+	if transport == nil {
+		transport = DefaultTransport
+	}
+	return &httputil.ReverseProxy{
+		Rewrite: func(r *httputil.ProxyRequest) {
+			r.Out.URL.Scheme = Scheme
+			r.Out.URL.Host = service
+			r.Out.Host = ""
+			r.SetXForwarded()
+		},
+		Transport: transport,
+	}
+}
+
+// NewNetworkReverseProxy returns a reverse proxy that forwards the requests
+// it is given to target, an http or https URL, as
+// httputil.NewSingleHostReverseProxy does. Given to a Server, it bridges a
+// pipe to a network service, for components that may only use pipes. The
+// proxy sets the X-Forwarded headers, and can be customized further before
+// use.
+func NewNetworkReverseProxy(target *url.URL) *httputil.ReverseProxy {
+	return &httputil.ReverseProxy{
+		Rewrite: func(r *httputil.ProxyRequest) {
+			r.SetURL(target)
+			r.SetXForwarded()
+		},
+	}
+}
@@ -0,0 +1,122 @@
+/*
+   Copyright 2018 Docker, Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package httpnpipe
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// RateLimit limits how fast each client of a Server may send requests, so
+// that a runaway local process cannot swamp it. Requests over the limit are
+// answered 429 Too Many Requests, with a Retry-After header.
+type RateLimit struct {
+	// Rate is how many requests a second a client may make over time, and
+	// Burst how many it may make at once; Burst less than 1 means 1.
+	Rate  float64
+	Burst int
+	// PerUser, if true, has all the clients run by one user share a
+	// limit, rather than each process having its own, so that starting
+	// more processes does not get round it.
+	PerUser bool
+}
+
+// rateLimiter keeps a token bucket for each client of a Server.
+type rateLimiter struct {
+	limit     RateLimit
+	mutex     sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(limit RateLimit) *rateLimiter {
+	limit.Burst = max(limit.Burst, 1)
+	return &rateLimiter{limit: limit, buckets: make(map[string]*bucket)}
+}
+
+// key returns the bucket client is counted in. Clients whose identity is
+// unknown share one.
+func (rl *rateLimiter) key(client ClientIdentity, ok bool) string {
+	switch {
+	case !ok:
+		return ""
+	case rl.limit.PerUser && client.SID != "":
+		return client.SID
+	}
+	return strconv.FormatUint(uint64(client.ProcessID), 10)
+}
+
+// allow takes a token from the bucket of key, reporting whether there was
+// one, and if not how long until there is.
+func (rl *rateLimiter) allow(key string, now time.Time) (bool, time.Duration) {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+	burst := float64(rl.limit.Burst)
+	if now.Sub(rl.lastSweep) > time.Minute {
+		// Buckets that have filled up again are no different from new
+		// ones, so they go, lest clients long gone pile up.
+		for k, b := range rl.buckets {
+			if rl.refill(b, now) >= burst {
+				delete(rl.buckets, k)
+			}
+		}
+		rl.lastSweep = now
+	}
+	b, ok := rl.buckets[key]
+	if !ok {
+		b = &bucket{tokens: burst, last: now}
+		rl.buckets[key] = b
+	}
+	b.tokens = rl.refill(b, now)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	if rl.limit.Rate <= 0 {
+		return false, time.Hour
+	}
+	return false, time.Duration((1 - b.tokens) / rl.limit.Rate * float64(time.Second))
+}
+
+// refill returns how many tokens b holds at now.
+func (rl *rateLimiter) refill(b *bucket, now time.Time) float64 {
+	tokens := b.tokens + now.Sub(b.last).Seconds()*rl.limit.Rate
+	return math.Min(tokens, float64(rl.limit.Burst))
+}
+
+// rateLimitHandler answers the requests of clients over the limit of rl
+// with 429 Too Many Requests, and passes the others on to handler.
+func rateLimitHandler(handler http.Handler, rl *rateLimiter) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		client, ok := ClientIdentityFromContext(r.Context())
+		if allowed, wait := rl.allow(rl.key(client, ok), time.Now()); !allowed {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			http.Error(w, "too many requests", http.StatusTooManyRequests)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
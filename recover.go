@@ -0,0 +1,60 @@
+/*
+   Copyright 2018 Docker, Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package httpnpipe
+
+import (
+	"net/http"
+	"runtime/debug"
+)
+
+// recoverHandler returns handler, made to recover from its panics if srv
+// has RecoverPanics set.
+func (srv *Server) recoverHandler(handler http.Handler) http.Handler {
+	if handler == nil {
+		handler = http.DefaultServeMux
+	}
+	if !srv.RecoverPanics {
+		return handler
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := &responseRecorder{ResponseWriter: w}
+		defer func() {
+			value := recover()
+			if value == nil {
+				return
+			}
+			if value == http.ErrAbortHandler {
+				panic(value)
+			}
+			if srv.OnPanic != nil {
+				srv.OnPanic(r, value, debug.Stack())
+			}
+			if rec.status != 0 || rec.hijacked {
+				// Too late for an error response; aborting the handler
+				// at least keeps the client from taking what was sent
+				// for the whole response.
+				panic(http.ErrAbortHandler)
+			}
+			clear(w.Header())
+			if r.ProtoMajor == 1 {
+				w.Header().Set("Connection", "close")
+			}
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		}()
+		handler.ServeHTTP(rec, r)
+	})
+}
@@ -0,0 +1,290 @@
+/*
+   Copyright 2018 Docker, Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package httpnpipe
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+// A Registry maps service names to named pipes. Every Transport has one,
+// created on first use, which its registration methods act on; a Registry
+// can also be built and populated on its own, and shared by several
+// Transports with SetRegistry, for instance ones with different timeouts.
+//
+// The zero value is an empty Registry ready to use. A Registry is safe for
+// concurrent use, and requests look up services without taking a lock.
+type Registry struct {
+	mutex sync.Mutex
+	// the current service mappings, replaced whole under mutex
+	routes atomic.Pointer[routes]
+	// the mappings as changed since mutex was taken, to replace routes
+	// with when it is released; nil if they are unchanged
+	staged *routes
+	// timers removing the services registered with a TTL
+	expiries map[string]*expiry
+	// number of dialers registered, for naming them
+	dialerSeq int
+	// Transports using the registry, whose idle connections must follow
+	// its changes
+	transports map[*Transport]struct{}
+}
+
+// NewRegistry returns an empty Registry.
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+// Register maps serviceName to pipeName. It returns an error wrapping
+// ErrServiceRegistered if serviceName is already registered.
+func (reg *Registry) Register(serviceName string, pipeName string, opts ...RegisterOption) error {
+	var options registration
+	for _, opt := range opts {
+		opt(&options)
+	}
+	reg.mutex.Lock()
+	defer reg.unlockAndNotify()
+	if reg.currentLocked().registered(serviceName) {
+		return fmt.Errorf("%w: %q", ErrServiceRegistered, serviceName)
+	}
+	reg.setPipeLocked(serviceName, pipeName)
+	if options.labels != nil || options.streaming || options.framed || options.negotiated {
+		reg.updateLocked(func(r *routes) {
+			if options.labels != nil {
+				r.labels[serviceName] = options.labels
+			}
+			if options.streaming {
+				r.streaming[serviceName] = true
+			}
+			if options.framed {
+				r.framed[serviceName] = true
+			}
+			if options.negotiated {
+				r.negotiated[serviceName] = true
+			}
+		})
+	}
+	return nil
+}
+
+// Replace maps serviceName to pipeName whether or not it is already
+// registered. If serviceName was an alias, it stops being one.
+func (reg *Registry) Replace(serviceName string, pipeName string) {
+	reg.mutex.Lock()
+	defer reg.unlockAndNotify()
+	reg.setPipeLocked(serviceName, pipeName)
+}
+
+// Alias makes alias another name for service: requests for either go to
+// the same pipe, and share pooled connections. service need not be
+// registered yet. It is an error, wrapping ErrServiceRegistered, for alias
+// to be registered already, as a service or an alias. It is an error too
+// for alias to be what other aliases stand for, as aliases do not chain.
+func (reg *Registry) Alias(alias string, service string) error {
+	reg.mutex.Lock()
+	defer reg.unlockAndNotify()
+	r := reg.currentLocked()
+	if r.registered(alias) {
+		return fmt.Errorf("%w: %q", ErrServiceRegistered, alias)
+	}
+	service = r.canonical(service)
+	if service == alias {
+		return fmt.Errorf("http+npipe: alias %q refers to itself", alias)
+	}
+	if r.aliased(alias) {
+		return fmt.Errorf("http+npipe: alias %q has aliases of its own", alias)
+	}
+	reg.updateLocked(func(r *routes) {
+		r.aliases[alias] = service
+	})
+	return nil
+}
+
+// Unregister removes the mapping for serviceName, if there is one.
+// Unregistering an alias removes just the alias.
+func (reg *Registry) Unregister(serviceName string) {
+	reg.mutex.Lock()
+	defer reg.unlockAndNotify()
+	reg.unregisterLocked(serviceName)
+}
+
+// SetDefaultPipe makes pipeName the pipe for any service that has not been
+// registered. An empty pipeName removes the default again.
+func (reg *Registry) SetDefaultPipe(pipeName string) {
+	reg.mutex.Lock()
+	defer reg.unlockAndNotify()
+	reg.setDefaultPipeLocked(pipeName)
+}
+
+// Lookup returns the pipe that requests for serviceName go to: the one
+// registered for it, or else the default pipe. For a service registered
+// with RegisterDialer, it returns a description of the dialer instead.
+func (reg *Registry) Lookup(serviceName string) (pipeName string, ok bool) {
+	r := reg.current()
+	return r.pipeFor(r.canonical(serviceName))
+}
+
+// Services returns a copy of the registered mappings from service names to
+// pipes.
+func (reg *Registry) Services() map[string]string {
+	pipes := reg.current().pipes
+	services := make(map[string]string, len(pipes))
+	for service, pipeName := range pipes {
+		services[service] = pipeName
+	}
+	return services
+}
+
+// current returns the current snapshot of the service mappings.
+func (reg *Registry) current() *routes {
+	if r := reg.routes.Load(); r != nil {
+		return r
+	}
+	return noRoutes
+}
+
+// currentLocked returns the service mappings as changed so far under
+// reg.mutex.
+func (reg *Registry) currentLocked() *routes {
+	if reg.staged != nil {
+		return reg.staged
+	}
+	return reg.current()
+}
+
+// updateLocked changes the service mappings by update. All the changes
+// made under one hold of reg.mutex are published together when
+// unlockAndNotify releases it, so that requests see either none of them or
+// all of them.
+func (reg *Registry) updateLocked(update func(r *routes)) {
+	if reg.staged == nil {
+		reg.staged = reg.current().clone()
+	}
+	update(reg.staged)
+}
+
+func (reg *Registry) setPipeLocked(serviceName string, pipeName string) {
+	reg.updateLocked(func(r *routes) {
+		delete(r.aliases, serviceName)
+		delete(r.dialers, serviceName)
+		delete(r.labels, serviceName)
+		delete(r.streaming, serviceName)
+		delete(r.framed, serviceName)
+		delete(r.negotiated, serviceName)
+		r.pipes[serviceName] = pipeName
+	})
+	reg.stopExpiryLocked(serviceName)
+}
+
+func (reg *Registry) unregisterLocked(serviceName string) {
+	reg.updateLocked(func(r *routes) {
+		if _, isAlias := r.aliases[serviceName]; isAlias {
+			delete(r.aliases, serviceName)
+			return
+		}
+		delete(r.pipes, serviceName)
+		delete(r.dialers, serviceName)
+		delete(r.labels, serviceName)
+		delete(r.streaming, serviceName)
+		delete(r.framed, serviceName)
+		delete(r.negotiated, serviceName)
+	})
+	reg.stopExpiryLocked(serviceName)
+}
+
+func (reg *Registry) setDefaultPipeLocked(pipeName string) {
+	if reg.currentLocked().defaultPipe == pipeName {
+		return
+	}
+	reg.updateLocked(func(r *routes) {
+		r.defaultPipe = pipeName
+	})
+}
+
+// unlockAndNotify publishes the changes made to the mappings, if any, and
+// releases reg.mutex. It then has the Transports using reg drop their idle
+// connections that no longer match the mappings.
+func (reg *Registry) unlockAndNotify() {
+	if reg.staged == nil {
+		reg.mutex.Unlock()
+		return
+	}
+	reg.routes.Store(reg.staged)
+	reg.staged = nil
+	transports := make([]*Transport, 0, len(reg.transports))
+	for transport := range reg.transports {
+		transports = append(transports, transport)
+	}
+	reg.mutex.Unlock()
+	for _, transport := range transports {
+		transport.pruneIdleConns()
+	}
+}
+
+// attach has transport follow the changes to reg.
+func (reg *Registry) attach(transport *Transport) {
+	reg.mutex.Lock()
+	defer reg.mutex.Unlock()
+	if reg.transports == nil {
+		reg.transports = make(map[*Transport]struct{})
+	}
+	reg.transports[transport] = struct{}{}
+}
+
+// detach undoes attach.
+func (reg *Registry) detach(transport *Transport) {
+	reg.mutex.Lock()
+	defer reg.mutex.Unlock()
+	delete(reg.transports, transport)
+}
+
+// Registry returns the Registry holding the Transport's service mappings,
+// which can be shared with other Transports through SetRegistry.
+func (transport *Transport) Registry() *Registry {
+	if reg := transport.registry.Load(); reg != nil {
+		return reg
+	}
+	reg := &Registry{}
+	reg.attach(transport)
+	if !transport.registry.CompareAndSwap(nil, reg) {
+		reg.detach(transport)
+		return transport.registry.Load()
+	}
+	return reg
+}
+
+// SetRegistry makes reg the source of the Transport's service mappings in
+// one step, replacing those it had. Idle connections that do not match the
+// new mappings are closed, and connections in use are closed once their
+// requests are done if they no longer match. A nil reg gives the Transport
+// a new, empty Registry.
+func (transport *Transport) SetRegistry(reg *Registry) {
+	if reg == nil {
+		reg = &Registry{}
+	}
+	reg.attach(transport)
+	if old := transport.registry.Swap(reg); old != nil && old != reg {
+		old.detach(transport)
+	}
+	transport.pruneIdleConns()
+}
+
+// routes returns the current service mappings of the Transport.
+func (transport *Transport) routes() *routes {
+	return transport.Registry().current()
+}
@@ -0,0 +1,212 @@
+/*
+   Copyright 2018 Docker, Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package httpnpipe
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// trafficTest sends requests to http+npipe://svc/ from several goroutines
+// until stop is closed, passing each outcome to check along with whether
+// changed was set before the request was made.
+func trafficTest(client *http.Client, changed *atomic.Bool, stop <-chan struct{}, check func(changed bool, body string, err error) error) <-chan error {
+	errs := make(chan error, 8)
+	var wg sync.WaitGroup
+	for i := 0; i < cap(errs); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				before := changed.Load()
+				body, err := getBody(client, "http+npipe://svc/")
+				if err := check(before, body, err); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(errs)
+	}()
+	return errs
+}
+
+func TestRemapDuringTraffic(t *testing.T) {
+	inHandler := make(chan struct{})
+	release := make(chan struct{})
+	a := startTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			close(inHandler)
+			<-release
+		}
+		io.WriteString(w, "a")
+	})
+	b := startTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "b")
+	})
+	transport := &Transport{}
+	defer transport.Close()
+	transport.RegisterTargetService("svc", a.path)
+	client := &http.Client{Transport: transport}
+
+	slow := make(chan error, 1)
+	go func() {
+		body, err := getBody(client, "http+npipe://svc/slow")
+		if err == nil && body != "a" {
+			err = fmt.Errorf("in-flight request got %q", body)
+		}
+		slow <- err
+	}()
+	<-inHandler
+
+	var moved atomic.Bool
+	stop := make(chan struct{})
+	errs := trafficTest(client, &moved, stop, func(moved bool, body string, err error) error {
+		if err != nil {
+			return err
+		}
+		if moved && body != "b" {
+			return fmt.Errorf("request made after the remap got %q", body)
+		}
+		return nil
+	})
+	time.Sleep(50 * time.Millisecond)
+	transport.ReplaceTargetService("svc", b.path)
+	moved.Store(true)
+	time.Sleep(50 * time.Millisecond)
+	close(stop)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	close(release)
+	if err := <-slow; err != nil {
+		t.Errorf("in-flight request: %v", err)
+	}
+	waitFor(t, "connections to the old pipe to close", func() bool { return a.open.Load() == 0 })
+	if b.open.Load() == 0 {
+		t.Error("no connections to the new pipe")
+	}
+
+	var gone atomic.Bool
+	stop = make(chan struct{})
+	errs = trafficTest(client, &gone, stop, func(gone bool, body string, err error) error {
+		switch {
+		case errors.Is(err, ErrUnknownService):
+		case err != nil:
+			return err
+		case gone:
+			return fmt.Errorf("request made after unregistering got %q", body)
+		}
+		return nil
+	})
+	time.Sleep(50 * time.Millisecond)
+	transport.UnregisterTargetService("svc")
+	gone.Store(true)
+	time.Sleep(50 * time.Millisecond)
+	close(stop)
+	for err := range errs {
+		t.Error(err)
+	}
+	waitFor(t, "connections to the unregistered pipe to close", func() bool { return b.open.Load() == 0 })
+}
+
+func TestConfigReloadIsAtomic(t *testing.T) {
+	services := func(pipeName string) *Config {
+		config := &Config{Services: map[string]string{}}
+		for i := 0; i < 20; i++ {
+			config.Services[fmt.Sprintf("svc%d", i)] = pipeName
+		}
+		return config
+	}
+	reg := NewRegistry()
+	stop := make(chan struct{})
+	torn := make(chan string, 1)
+	go func() {
+		for {
+			select {
+			case <-stop:
+				close(torn)
+				return
+			default:
+			}
+			r := reg.current()
+			seen := map[string]bool{}
+			for i := 0; i < 20; i++ {
+				pipeName, _ := r.pipeFor(fmt.Sprintf("svc%d", i))
+				seen[pipeName] = true
+			}
+			if len(seen) > 1 {
+				torn <- fmt.Sprint(seen)
+				return
+			}
+		}
+	}()
+	if err := reg.loadConfig(services(`\\.\pipe\a`)); err != nil {
+		t.Fatal(err)
+	}
+	prev := services(`\\.\pipe\a`)
+	for i := 0; i < 100; i++ {
+		next := services(fmt.Sprintf(`\\.\pipe\%d`, i))
+		reg.applyConfig(prev, next)
+		prev = next
+	}
+	close(stop)
+	if seen, ok := <-torn; ok {
+		t.Fatalf("a request saw a reload half done: %s", seen)
+	}
+}
+
+func TestAliasOfAliasTarget(t *testing.T) {
+	s := startTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "b")
+	})
+	reg := &Registry{}
+	if err := reg.Alias("a", "b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := reg.Alias("b", "c"); err == nil {
+		t.Fatal("made an alias of a name another alias stands for")
+	}
+	if err := reg.Register("b", s.path); err != nil {
+		t.Fatal(err)
+	}
+	transport := &Transport{}
+	defer transport.Close()
+	transport.SetRegistry(reg)
+	body, err := getBody(&http.Client{Transport: transport}, "http+npipe://a/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body != "b" {
+		t.Fatalf("got body %q through the alias, want %q", body, "b")
+	}
+}
@@ -0,0 +1,131 @@
+/*
+   Copyright 2018 Docker, Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package httpnpipe
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// pipeHost returns the machine named by a pipe path of the form
+// \\host\pipe\name or //host/pipe/name, and whether that is another machine
+// than the local one.
+func pipeHost(pipeName string) (host string, remote bool) {
+	if len(pipeName) < 2 || !isPathSeparator(pipeName[0]) || !isPathSeparator(pipeName[1]) {
+		return "", false
+	}
+	host = pipeName[2:]
+	if i := strings.IndexAny(host, `\/`); i >= 0 {
+		host = host[:i]
+	}
+	return host, host != "."
+}
+
+func isPathSeparator(c byte) bool {
+	return c == '\\' || c == '/'
+}
+
+// IsRemotePipe reports whether pipeName names a pipe on another machine.
+func IsRemotePipe(pipeName string) bool {
+	_, remote := pipeHost(pipeName)
+	return remote
+}
+
+// isValidPipeHost reports whether host is a plausible machine name: a DNS
+// name, a NetBIOS name or an IPv4 address.
+func isValidPipeHost(host string) bool {
+	if host == "" || len(host) > 255 {
+		return false
+	}
+	for _, label := range strings.Split(host, ".") {
+		if label == "" || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for i := 0; i < len(label); i++ {
+			c := label[i]
+			switch {
+			case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+			case c == '-' || c == '_':
+			default:
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Credentials are the account a pipe on another machine is opened as, as
+// returned by Transport.RemoteCredentials. Username may also be given as
+// DOMAIN\user, or as a user principal name with an empty Domain.
+type Credentials struct {
+	Username string
+	Domain   string
+	Password string
+}
+
+// dialRemotePipe dials pipeName on host for service, going by
+// DenyRemotePipes, RemoteDialTimeout and RemoteCredentials. timeout is the
+// DialTimeout that applies otherwise.
+func (transport *Transport) dialRemotePipe(ctx context.Context, service, host, pipeName string, timeout time.Duration) (net.Conn, error) {
+	if !isValidPipeHost(host) {
+		return nil, fmt.Errorf("%w: bad host %q", ErrInvalidPipeName, host)
+	}
+	if transport.DenyRemotePipes {
+		return nil, fmt.Errorf("%w: %q", ErrRemotePipeDenied, pipeName)
+	}
+	var creds *Credentials
+	if transport.RemoteCredentials != nil {
+		var err error
+		if creds, err = transport.RemoteCredentials(ctx, service, host); err != nil {
+			return nil, err
+		}
+	}
+	dial := dialPipe
+	if creds != nil {
+		dial = func(ctx context.Context, pipeName string, timeout time.Duration) (net.Conn, error) {
+			return dialPipeAs(ctx, pipeName, timeout, creds)
+		}
+	}
+	if transport.RemoteDialTimeout != 0 {
+		timeout = transport.RemoteDialTimeout
+	}
+	if timeout < 0 {
+		return dial(ctx, pipeName, 0)
+	}
+	if timeout > 0 {
+		// The pipe's own timeout only covers waiting for a free instance,
+		// not reaching the machine, so bound the whole dial.
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	return dial(ctx, pipeName, timeout)
+}
+
+// account returns the user and domain of creds, splitting a username
+// given as DOMAIN\user.
+func (creds *Credentials) account() (user, domain string) {
+	if creds.Domain == "" {
+		if domain, user, ok := strings.Cut(creds.Username, `\`); ok {
+			return user, domain
+		}
+	}
+	return creds.Username, creds.Domain
+}
@@ -0,0 +1,31 @@
+//go:build !windows
+
+/*
+   Copyright 2018 Docker, Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package httpnpipe
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// dialPipeAs dials pipeName as the account creds give. Only Windows can
+// open pipes on other machines; elsewhere it returns ErrPipesUnsupported.
+func dialPipeAs(ctx context.Context, pipeName string, timeout time.Duration, creds *Credentials) (net.Conn, error) {
+	return nil, ErrPipesUnsupported
+}
@@ -0,0 +1,105 @@
+//go:build windows
+
+/*
+   Copyright 2018 Docker, Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package httpnpipe
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"runtime"
+	"time"
+	"unsafe"
+
+	"github.com/docker/go-connections/sockets"
+	"golang.org/x/sys/windows"
+)
+
+var (
+	procLogonUserW              = modadvapi32.NewProc("LogonUserW")
+	procImpersonateLoggedOnUser = modadvapi32.NewProc("ImpersonateLoggedOnUser")
+)
+
+const (
+	logon32LogonNewCredentials = 9
+	logon32ProviderWinNT50     = 3
+)
+
+// dialPipeAs dials pipeName with creds used for the connection to its
+// machine. The logon only makes a token for outbound network connections,
+// checked by the machine dialed rather than here, which is impersonated on
+// the thread that opens the pipe for just that long.
+func dialPipeAs(ctx context.Context, pipeName string, timeout time.Duration, creds *Credentials) (net.Conn, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	token, err := logonNewCredentials(creds)
+	if err != nil {
+		return nil, err
+	}
+	return dialAsync(ctx, func() (net.Conn, error) {
+		defer token.Close()
+		runtime.LockOSThread()
+		if r, _, err := procImpersonateLoggedOnUser.Call(uintptr(token)); r == 0 {
+			runtime.UnlockOSThread()
+			return nil, fmt.Errorf("%w: impersonating %s: %v", ErrRemoteLogon, creds.Username, err)
+		}
+		c, err := sockets.DialPipe(pipeName, timeout)
+		// A thread that cannot go back to the process's own token is left
+		// locked, so that it ends with this goroutine instead of running
+		// others as the wrong user.
+		if windows.RevertToSelf() == nil {
+			runtime.UnlockOSThread()
+		}
+		return c, err
+	})
+}
+
+func logonNewCredentials(creds *Credentials) (windows.Token, error) {
+	if err := modadvapi32.Load(); err != nil {
+		return 0, err
+	}
+	user, domain := creds.account()
+	u, err := windows.UTF16PtrFromString(user)
+	if err != nil {
+		return 0, err
+	}
+	var d *uint16
+	if domain != "" {
+		if d, err = windows.UTF16PtrFromString(domain); err != nil {
+			return 0, err
+		}
+	}
+	p, err := windows.UTF16PtrFromString(creds.Password)
+	if err != nil {
+		return 0, err
+	}
+	var token windows.Token
+	r, _, err := procLogonUserW.Call(
+		uintptr(unsafe.Pointer(u)),
+		uintptr(unsafe.Pointer(d)),
+		uintptr(unsafe.Pointer(p)),
+		logon32LogonNewCredentials,
+		logon32ProviderWinNT50,
+		uintptr(unsafe.Pointer(&token)),
+	)
+	if r == 0 {
+		return 0, fmt.Errorf("%w: %s: %v", ErrRemoteLogon, creds.Username, err)
+	}
+	return token, nil
+}
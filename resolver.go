@@ -0,0 +1,85 @@
+/*
+   Copyright 2018 Docker, Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package httpnpipe
+
+import (
+	"context"
+	"fmt"
+)
+
+// A Resolver maps service names to named pipes for a Transport, in place of
+// the mappings registered with RegisterTargetService. It is given the
+// context of the request being made.
+//
+// Resolve should return an error wrapping ErrUnknownService for a service
+// it does not know about.
+type Resolver interface {
+	Resolve(ctx context.Context, service string) (pipeName string, err error)
+}
+
+// ResolverFunc adapts an ordinary function to a Resolver.
+type ResolverFunc func(ctx context.Context, service string) (pipeName string, err error)
+
+// Resolve calls f(ctx, service).
+func (f ResolverFunc) Resolve(ctx context.Context, service string) (string, error) {
+	return f(ctx, service)
+}
+
+// resolve returns the pipe behind service.
+func (transport *Transport) resolve(ctx context.Context, service string) (string, error) {
+	if transport.Resolver != nil {
+		return transport.Resolver.Resolve(ctx, service)
+	}
+	if pipeName, ok := transport.routes().pipeFor(service); ok {
+		return pipeName, nil
+	}
+	if transport.OnUnknownService != nil {
+		return transport.resolveUnknown(service)
+	}
+	return "", fmt.Errorf("%w: %q", ErrUnknownService, service)
+}
+
+// reresolve returns the pipe now behind service, which was reached through
+// pipeName.
+func (transport *Transport) reresolve(ctx context.Context, service, pipeName string) (string, error) {
+	if service == pipeName {
+		// Named by the URL, so it cannot move.
+		return pipeName, nil
+	}
+	return transport.resolve(ctx, service)
+}
+
+// resolveUnknown asks OnUnknownService for the pipe of service, and
+// registers the answer.
+func (transport *Transport) resolveUnknown(service string) (string, error) {
+	pipeName, err := transport.OnUnknownService(service)
+	if err != nil {
+		return "", err
+	}
+	if pipeName == "" {
+		return "", fmt.Errorf("%w: %q", ErrUnknownService, service)
+	}
+	reg := transport.Registry()
+	reg.mutex.Lock()
+	defer reg.unlockAndNotify()
+	if registered, ok := reg.currentLocked().registeredPipe(service); ok {
+		// Registered meanwhile, by another request or the application.
+		return registered, nil
+	}
+	reg.setPipeLocked(service, pipeName)
+	return pipeName, nil
+}
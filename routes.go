@@ -0,0 +1,173 @@
+/*
+   Copyright 2018 Docker, Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package httpnpipe
+
+import "strings"
+
+// routes is a snapshot of the service mappings of a Registry. Snapshots
+// are never modified once published, so requests read them without taking
+// any lock; changes are made to a copy, under the Registry's mutex, which
+// then replaces the snapshot.
+type routes struct {
+	// map a URL "hostname" to a named pipe
+	pipes map[string]string
+	// map an alias to the service it stands for
+	aliases map[string]string
+	// map a service to the dialer standing in for its pipe
+	dialers map[string]*serviceDialer
+	// labels of the services registered with some; never modified
+	labels map[string]map[string]string
+	// services registered WithStreamingService
+	streaming map[string]bool
+	// services registered WithMessageFraming
+	framed map[string]bool
+	// services registered WithProtocolNegotiation
+	negotiated map[string]bool
+	// pipe name with "{service}" for services missing from pipes, if not
+	// empty
+	pipeTemplate string
+	// pipe for services missing from pipes, if not empty
+	defaultPipe string
+}
+
+var noRoutes = &routes{}
+
+// clone returns a copy of r that can be changed.
+func (r *routes) clone() *routes {
+	c := &routes{
+		pipes:        make(map[string]string, len(r.pipes)),
+		aliases:      make(map[string]string, len(r.aliases)),
+		dialers:      make(map[string]*serviceDialer, len(r.dialers)),
+		labels:       make(map[string]map[string]string, len(r.labels)),
+		streaming:    make(map[string]bool, len(r.streaming)),
+		framed:       make(map[string]bool, len(r.framed)),
+		negotiated:   make(map[string]bool, len(r.negotiated)),
+		pipeTemplate: r.pipeTemplate,
+		defaultPipe:  r.defaultPipe,
+	}
+	for service, pipeName := range r.pipes {
+		c.pipes[service] = pipeName
+	}
+	for alias, service := range r.aliases {
+		c.aliases[alias] = service
+	}
+	for service, d := range r.dialers {
+		c.dialers[service] = d
+	}
+	for service, labels := range r.labels {
+		c.labels[service] = labels
+	}
+	for service := range r.streaming {
+		c.streaming[service] = true
+	}
+	for service := range r.framed {
+		c.framed[service] = true
+	}
+	for service := range r.negotiated {
+		c.negotiated[service] = true
+	}
+	return c
+}
+
+// registered reports whether name is a registered service or alias.
+func (r *routes) registered(name string) bool {
+	_, isService := r.pipes[name]
+	_, isAlias := r.aliases[name]
+	_, isDialer := r.dialers[name]
+	return isService || isAlias || isDialer
+}
+
+// registeredPipe returns the pipe registered for service, or the name of
+// its dialer, ignoring the default pipe.
+func (r *routes) registeredPipe(service string) (string, bool) {
+	if pipeName, ok := r.pipes[service]; ok {
+		return pipeName, true
+	}
+	if d, ok := r.dialers[service]; ok {
+		return d.name, true
+	}
+	return "", false
+}
+
+// pipeFor returns the pipe registered for service, or the name of its
+// dialer, falling back to the pipe template and then the default pipe.
+func (r *routes) pipeFor(service string) (string, bool) {
+	if pipeName, ok := r.registeredPipe(service); ok {
+		return pipeName, true
+	}
+	if r.pipeTemplate != "" && isTemplateService(service) {
+		return strings.ReplaceAll(r.pipeTemplate, serviceVar, service), true
+	}
+	return r.defaultPipe, r.defaultPipe != ""
+}
+
+// leadsTo reports whether connections to pipeName are still right for
+// service. A service named after its pipe comes from a URL naming the pipe,
+// and needs no mapping.
+func (r *routes) leadsTo(service, pipeName string) bool {
+	if service == pipeName {
+		return true
+	}
+	registered, ok := r.pipeFor(service)
+	return ok && registered == pipeName
+}
+
+// routesTo reports whether some service is still reached through
+// pipeName, by its mapping or the default pipe.
+func (r *routes) routesTo(pipeName string) bool {
+	if pipeName == r.defaultPipe {
+		return true
+	}
+	for _, p := range r.pipes {
+		if p == pipeName {
+			return true
+		}
+	}
+	for _, d := range r.dialers {
+		if d.name == pipeName {
+			return true
+		}
+	}
+	return false
+}
+
+// canonical returns the service that service is an alias of, or service
+// itself.
+func (r *routes) canonical(service string) string {
+	if target, ok := r.aliases[service]; ok {
+		return target
+	}
+	return service
+}
+
+// aliased reports whether some alias stands for service.
+func (r *routes) aliased(service string) bool {
+	for _, target := range r.aliases {
+		if target == service {
+			return true
+		}
+	}
+	return false
+}
+
+// dialerFor returns the dialer registered for service under name, if any.
+func (r *routes) dialerFor(service, name string) *serviceDialer {
+	if d, ok := r.dialers[service]; ok && d.name == name {
+		return d
+	}
+	return nil
+}
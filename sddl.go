@@ -0,0 +1,30 @@
+/*
+   Copyright 2018 Docker, Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package httpnpipe
+
+// Security descriptors for ListenConfig.SecurityDescriptor, in SDDL form.
+// Without one, a pipe gets the default security of the process creating
+// it, which lets administrators, SYSTEM and the creator's user connect.
+const (
+	// SDDLAdminsOnly lets only administrators and SYSTEM connect.
+	SDDLAdminsOnly = "D:P(A;;GA;;;BA)(A;;GA;;;SY)"
+
+	// SDDLEveryone lets any user connect, though not anonymous network
+	// clients, which Windows leaves out of Everyone. It suits pipes whose
+	// server checks each client itself.
+	SDDLEveryone = "D:P(A;;GA;;;WD)"
+)
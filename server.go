@@ -0,0 +1,477 @@
+/*
+   Copyright 2018 Docker, Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package httpnpipe
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// A Server serves HTTP on a named pipe, for clients using a Transport. It
+// is a thin layer over http.Server; the fields mean the same as there.
+// Handlers can find out who the client is with ClientIdentityFromContext.
+type Server struct {
+	// PipeName is the pipe ListenAndServe creates, such as
+	// \\.\pipe\myapp.
+	PipeName string
+	// PipeNames lists more pipes to create and serve alike, such as the
+	// legacy name of a pipe that has been renamed.
+	PipeNames []string
+	// Endpoints lists more places for ListenAndServe to listen on, as
+	// Listen does: pipes, or unix sockets on systems without pipes. This
+	// lets code shared between Windows and other systems serve the same
+	// handler wherever it runs.
+	Endpoints []string
+	// ListenConfig configures the pipes; nil means the zero ListenConfig.
+	ListenConfig *ListenConfig
+
+	// Handler answers the requests; nil means http.DefaultServeMux.
+	Handler http.Handler
+
+	// ReadHeaderTimeout limits how long a client may take to send the
+	// header of a request, and IdleTimeout how long a connection may sit
+	// idle between requests, so that slow or abandoned clients do not hold
+	// on to pipe instances for ever. Zero means
+	// DefaultServerReadHeaderTimeout and DefaultServerIdleTimeout, and a
+	// negative value no limit. ReadTimeout and WriteTimeout limit the
+	// reading of a whole request and the writing of its response as in
+	// http.Server; zero means no limit, which suits streamed responses.
+	ReadTimeout       time.Duration
+	ReadHeaderTimeout time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+	MaxHeaderBytes    int
+
+	// MaxConcurrentConnections, if positive, limits how many client
+	// connections are open at a time, so that a flood of clients cannot
+	// use up the server's pipe instances and handles. Connections over the
+	// limit wait to be accepted until one closes, unless
+	// RejectExcessConnections is set, in which case they are closed at
+	// once and counted by RejectedConnections.
+	MaxConcurrentConnections int
+	RejectExcessConnections  bool
+
+	// OnAccept, if non-nil, is called for each connection accepted, with
+	// the identity of the client if known. OnRequest, if non-nil, is
+	// called with each request before it is handled, and OnResponse after,
+	// with how it was answered. They suit access logs and metrics, and
+	// should be quick: OnAccept holds up accepting the next connection,
+	// and the others the request.
+	OnAccept   func(conn net.Conn, client ClientIdentity)
+	OnRequest  func(r *http.Request)
+	OnResponse func(r *http.Request, info ResponseInfo)
+
+	// ConnContext, if non-nil, modifies the context of each connection, as
+	// in http.Server, so that per-connection state such as a cache of
+	// credentials is there for every request that comes over it. The
+	// context it is given already carries the client's identity, for
+	// ClientIdentityFromContext.
+	ConnContext func(ctx context.Context, conn net.Conn) context.Context
+
+	// RecoverPanics, if true, has a handler that panics answered 500
+	// Internal Server Error, on a connection then closed, or if the
+	// response had been started, has that connection closed mid-way, and
+	// the panic reported to OnPanic rather than to the log. Otherwise
+	// panics are dealt with as by http.Server.
+	RecoverPanics bool
+	OnPanic       func(r *http.Request, value any, stack []byte)
+
+	// AcceptPolicy, if non-nil, decides whether to serve each client that
+	// connects, before anything is read from it; client is the zero
+	// ClientIdentity if it is unknown. A connection it returns an error
+	// for is closed at once, and OnRejectedClient, if non-nil, is called
+	// with the client and the error, for auditing. AllowClients makes a
+	// policy out of a list of user and group SIDs.
+	AcceptPolicy     func(client ClientIdentity) error
+	OnRejectedClient func(client ClientIdentity, err error)
+
+	// RateLimit, if non-nil, limits how fast each client may send
+	// requests.
+	RateLimit *RateLimit
+
+	// InjectPeerHeaders, if true, has each request carry the identity of
+	// its client in the HeaderClientPID and HeaderClientUser headers, for
+	// handlers written for TCP to use without knowing about pipes. Those
+	// headers are dropped from what clients send, so they can be trusted.
+	InjectPeerHeaders bool
+
+	// TLSConfig, if non-nil, has the Server speak HTTPS, with TLS over
+	// each connection, for installations that want encryption and
+	// certificate-based authentication even over pipes. It must provide a
+	// certificate, and can ask clients for theirs. HTTP/2 is offered to
+	// clients through ALPN.
+	TLSConfig *tls.Config
+
+	// HealthEndpoints, if true, has the Server answer health probes on
+	// HealthPath and ReadyPath itself, so that watchdogs can check any
+	// service the same way, with ProbeService say. The Server is ready
+	// while it is not shutting down and Readiness, if non-nil, returns
+	// nil.
+	HealthEndpoints bool
+	Readiness       func() error
+
+	// TakeoverPipe opts in to restarts without downtime. When
+	// ListenAndServe cannot create a pipe because an older Server with
+	// TakeoverPipe set, run by the same user, holds it, it asks that
+	// Server to hand the pipe over, and creates it once freed. The older
+	// Server stops accepting connections at once, so that clients wait
+	// for the newer one, and lets the requests under way finish for up to
+	// TakeoverTimeout, or DefaultTakeoverTimeout if zero; then its
+	// ListenAndServe returns ErrServerHandedOver.
+	TakeoverPipe    bool
+	TakeoverTimeout time.Duration
+
+	// EnableH2C lets clients speak HTTP/2 in cleartext over the pipe, either
+	// with prior knowledge or by upgrading from HTTP/1.1, so that a client
+	// can multiplex its requests over one pipe connection rather than
+	// opening one per request in flight. HTTP/1.1 responses then carry
+	// HeaderMultiplex, for clients with NegotiateHTTP2 set.
+	EnableH2C bool
+
+	// NegotiateProtocols, if true, has each connection open with a
+	// protocol negotiation, so that one pipe can serve HTTP and other
+	// protocols alike: the client offers the IDs of the protocols it
+	// speaks, and the Server picks the first of them it serves. Those are
+	// HTTP, as "http/1.1", "h2c" with EnableH2C, or "h2" with TLSConfig,
+	// which is served as usual, and the protocols of ProtocolHandlers.
+	// Clients have to negotiate too, as a Transport does for services
+	// registered WithProtocolNegotiation, and DialProtocol does.
+	NegotiateProtocols bool
+
+	// ProtocolHandlers serves the connections that settle on protocols
+	// other than HTTP under NegotiateProtocols, keyed by protocol ID. A
+	// handler gets the connection once the negotiation is over, in a
+	// goroutine of its own, and has to close it.
+	ProtocolHandlers map[string]func(net.Conn)
+
+	// OnListenerRecreated, if non-nil, is called each time ListenAndServe
+	// has re-created the listener on endpoint after it failed with err.
+	// Rather than stop serving an endpoint whose listener dies,
+	// ListenAndServe listens on it again, retrying until it succeeds or
+	// the Server is shut down or closed; ListenerRecreations counts how
+	// often.
+	OnListenerRecreated func(endpoint string, err error)
+
+	mutex     sync.Mutex
+	server    *http.Server
+	serverErr error
+	limit     *connLimit
+	done      chan struct{}
+	doneOnce  sync.Once
+	handover  chan struct{}
+	recreated atomic.Uint64
+}
+
+const (
+	// DefaultServerReadHeaderTimeout is the ReadHeaderTimeout of a Server
+	// that sets none.
+	DefaultServerReadHeaderTimeout = 10 * time.Second
+	// DefaultServerIdleTimeout is the IdleTimeout of a Server that sets
+	// none.
+	DefaultServerIdleTimeout = 2 * time.Minute
+)
+
+// ListenAndServe creates the pipes PipeName and PipeNames, and listens on
+// Endpoints, and serves requests on all of them until the Server is shut
+// down or closed, when it returns http.ErrServerClosed. If one of them
+// cannot be listened on, it returns that error without serving any.
+func (srv *Server) ListenAndServe() error {
+	var endpoints []endpoint
+	if srv.PipeName != "" {
+		endpoints = append(endpoints, endpoint{srv.PipeName, true})
+	}
+	for _, pipeName := range srv.PipeNames {
+		endpoints = append(endpoints, endpoint{pipeName, true})
+	}
+	for _, name := range srv.Endpoints {
+		endpoints = append(endpoints, endpoint{name, false})
+	}
+	if len(endpoints) == 0 {
+		return errors.New("http+npipe: server has no pipe name or endpoints")
+	}
+	if _, err := srv.httpServerErr(); err != nil {
+		return err
+	}
+
+	var listeners []net.Listener
+	for _, ep := range endpoints {
+		l, err := srv.listen(ep)
+		if err != nil && ep.pipe && srv.TakeoverPipe {
+			l, err = srv.takeOver(ep, err)
+		}
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return err
+		}
+		listeners = append(listeners, l)
+	}
+
+	errs := make(chan error, len(listeners))
+	for i, l := range listeners {
+		go func(ep endpoint, l net.Listener) {
+			errs <- srv.serveEndpoint(ep, l)
+		}(endpoints[i], l)
+	}
+	err := http.ErrServerClosed
+	for range listeners {
+		if e := <-errs; e != http.ErrServerClosed && err == http.ErrServerClosed {
+			err = e
+		}
+	}
+	if handover := srv.handedOver(); handover != nil && err == http.ErrServerClosed {
+		<-handover
+		return ErrServerHandedOver
+	}
+	return err
+}
+
+// endpoint is a place a Server listens on: a pipe, or anything Listen
+// takes.
+type endpoint struct {
+	name string
+	pipe bool
+}
+
+func (srv *Server) listen(ep endpoint) (net.Listener, error) {
+	if ep.pipe {
+		return ListenPipe(ep.name, srv.ListenConfig)
+	}
+	return Listen(ep.name, srv.ListenConfig)
+}
+
+// serveEndpoint serves requests on l, listening on ep again each time the
+// listener fails, until the Server is shut down or closed. Serve failing
+// for any other reason ends it with that error.
+func (srv *Server) serveEndpoint(ep endpoint, l net.Listener) error {
+	const maxDelay = time.Second
+	done := srv.shutdownDone()
+	delay := 5 * time.Millisecond
+	for {
+		started := time.Now()
+		accepting := &acceptListener{Listener: l}
+		err := srv.Serve(accepting)
+		if err == http.ErrServerClosed || !accepting.failed.Load() {
+			return err
+		}
+		if time.Since(started) > maxDelay {
+			delay = 5 * time.Millisecond
+		}
+		for {
+			select {
+			case <-done:
+				return http.ErrServerClosed
+			case <-time.After(delay):
+			}
+			delay = min(2*delay, maxDelay)
+			var lerr error
+			if l, lerr = srv.listen(ep); lerr == nil {
+				break
+			}
+		}
+		srv.recreated.Add(1)
+		if srv.OnListenerRecreated != nil {
+			srv.OnListenerRecreated(ep.name, err)
+		}
+	}
+}
+
+// acceptListener records whether Accept has failed, which is what tells a
+// listener that died apart from the other reasons Serve returns for.
+type acceptListener struct {
+	net.Listener
+	failed atomic.Bool
+}
+
+func (l *acceptListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		l.failed.Store(true)
+	}
+	return c, err
+}
+
+// ListenerRecreations returns how many times ListenAndServe has re-created
+// a listener that failed.
+func (srv *Server) ListenerRecreations() uint64 {
+	return srv.recreated.Load()
+}
+
+// Serve serves requests on the connections accepted from l, which it
+// closes on return. It returns http.ErrServerClosed once the Server is shut
+// down or closed. Serve may be called for several listeners at once.
+func (srv *Server) Serve(l net.Listener) error {
+	if limit := srv.connLimit(); limit != nil {
+		l = newLimitListener(l, limit)
+	}
+	if srv.AcceptPolicy != nil {
+		l = &policyListener{Listener: l, srv: srv}
+	}
+	if srv.NegotiateProtocols {
+		l = newNegotiateListener(l, srv)
+	}
+	server, err := srv.httpServerErr()
+	if err != nil {
+		l.Close()
+		return err
+	}
+	if srv.TLSConfig != nil {
+		return server.ServeTLS(l, "", "")
+	}
+	return server.Serve(l)
+}
+
+// RejectedConnections returns how many connections have been closed for
+// going over MaxConcurrentConnections.
+func (srv *Server) RejectedConnections() uint64 {
+	if limit := srv.connLimit(); limit != nil {
+		return limit.rejected.Load()
+	}
+	return 0
+}
+
+// connLimit returns the limit on the connections to srv across its
+// listeners, or nil if there is none.
+func (srv *Server) connLimit() *connLimit {
+	if srv.MaxConcurrentConnections <= 0 {
+		return nil
+	}
+	srv.mutex.Lock()
+	defer srv.mutex.Unlock()
+	if srv.limit == nil {
+		srv.limit = &connLimit{
+			slots:  make(chan struct{}, srv.MaxConcurrentConnections),
+			reject: srv.RejectExcessConnections,
+		}
+	}
+	return srv.limit
+}
+
+// Shutdown stops the Server gracefully: it closes the pipe to new
+// connections and waits for the requests under way to finish, as
+// http.Server.Shutdown does. Unlike there, if ctx is done first the
+// connections still open are closed before Shutdown returns the context's
+// error, so that nothing is left behind.
+func (srv *Server) Shutdown(ctx context.Context) error {
+	srv.closeDone()
+	server := srv.httpServer()
+	err := server.Shutdown(ctx)
+	if err != nil {
+		server.Close()
+	}
+	return err
+}
+
+// Close closes the pipe and all connections at once, as http.Server.Close
+// does.
+func (srv *Server) Close() error {
+	srv.closeDone()
+	return srv.httpServer().Close()
+}
+
+// shutdownDone returns a channel closed once srv is shut down or closed.
+func (srv *Server) shutdownDone() chan struct{} {
+	srv.mutex.Lock()
+	defer srv.mutex.Unlock()
+	if srv.done == nil {
+		srv.done = make(chan struct{})
+	}
+	return srv.done
+}
+
+func (srv *Server) closeDone() {
+	done := srv.shutdownDone()
+	srv.doneOnce.Do(func() { close(done) })
+}
+
+// httpServer returns the http.Server behind srv, set up from its fields on
+// first use.
+func (srv *Server) httpServer() *http.Server {
+	server, _ := srv.httpServerErr()
+	return server
+}
+
+// httpServerErr returns the http.Server behind srv as httpServer does,
+// along with the error, if any, in setting it up for HTTP/2.
+func (srv *Server) httpServerErr() (*http.Server, error) {
+	srv.mutex.Lock()
+	defer srv.mutex.Unlock()
+	if srv.server == nil {
+		handler := srv.hookHandler(srv.recoverHandler(srv.Handler))
+		if srv.RateLimit != nil {
+			handler = rateLimitHandler(handler, newRateLimiter(*srv.RateLimit))
+		}
+		if srv.HealthEndpoints {
+			handler = srv.healthHandler(handler)
+		}
+		if srv.InjectPeerHeaders {
+			handler = peerHeaderHandler(handler)
+		}
+		if srv.TakeoverPipe {
+			handler = srv.takeoverHandler(handler)
+		}
+		var h2s *http2.Server
+		idleTimeout := serverTimeout(srv.IdleTimeout, DefaultServerIdleTimeout)
+		if srv.EnableH2C {
+			h2s = &http2.Server{IdleTimeout: idleTimeout}
+			handler = h2c.NewHandler(advertiseH2C(handler), h2s)
+		}
+		srv.server = &http.Server{
+			Handler:           handler,
+			ReadTimeout:       srv.ReadTimeout,
+			ReadHeaderTimeout: serverTimeout(srv.ReadHeaderTimeout, DefaultServerReadHeaderTimeout),
+			WriteTimeout:      srv.WriteTimeout,
+			IdleTimeout:       idleTimeout,
+			MaxHeaderBytes:    srv.MaxHeaderBytes,
+			ConnContext:       srv.connContext,
+			TLSConfig:         srv.TLSConfig.Clone(),
+		}
+		if h2s != nil {
+			// This lets Shutdown close the HTTP/2 connections gracefully
+			// too, and serves HTTP/2 over TLS. It fails only for TLS
+			// configs that leave out the ciphers HTTP/2 needs.
+			srv.serverErr = http2.ConfigureServer(srv.server, h2s)
+		}
+		if c := srv.TLSConfig; srv.serverErr == nil && c != nil &&
+			len(c.Certificates) == 0 && c.GetCertificate == nil && c.GetConfigForClient == nil {
+			srv.serverErr = errors.New("http+npipe: server TLSConfig provides no certificate")
+		}
+	}
+	return srv.server, srv.serverErr
+}
+
+// serverTimeout returns timeout, or def if it is zero and no timeout if it
+// is negative.
+func serverTimeout(timeout, def time.Duration) time.Duration {
+	switch {
+	case timeout == 0:
+		return def
+	case timeout < 0:
+		return 0
+	}
+	return timeout
+}
@@ -0,0 +1,50 @@
+/*
+   Copyright 2018 Docker, Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package httpnpipe
+
+import (
+	"crypto/tls"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestListenAndServeConfigError(t *testing.T) {
+	srv := &Server{
+		Endpoints: []string{filepath.Join(t.TempDir(), "http.sock")},
+		Handler:   http.NotFoundHandler(),
+		TLSConfig: &tls.Config{},
+		OnListenerRecreated: func(endpoint string, err error) {
+			t.Errorf("listener on %s re-created after %v", endpoint, err)
+		},
+	}
+	defer srv.Close()
+	errs := make(chan error, 1)
+	go func() { errs <- srv.ListenAndServe() }()
+	select {
+	case err := <-errs:
+		if err == nil || err == http.ErrServerClosed {
+			t.Errorf("ListenAndServe returned %v for a TLSConfig without certificates", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("ListenAndServe kept going with a TLSConfig without certificates")
+	}
+	if n := srv.ListenerRecreations(); n != 0 {
+		t.Errorf("%d listeners re-created", n)
+	}
+}
@@ -0,0 +1,26 @@
+//go:build !windows
+
+/*
+   Copyright 2018 Docker, Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package httpnpipe
+
+// SSPIAuthenticator returns an Authenticator for Windows integrated
+// authentication with the SSPI security package pkg. SSPI only exists on
+// Windows; elsewhere it returns ErrPipesUnsupported.
+func SSPIAuthenticator(pkg string) (Authenticator, error) {
+	return nil, ErrPipesUnsupported
+}
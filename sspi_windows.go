@@ -0,0 +1,168 @@
+//go:build windows
+
+/*
+   Copyright 2018 Docker, Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package httpnpipe
+
+import (
+	"fmt"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+var (
+	modsecur32 = windows.NewLazySystemDLL("secur32.dll")
+
+	procAcquireCredentialsHandleW  = modsecur32.NewProc("AcquireCredentialsHandleW")
+	procInitializeSecurityContextW = modsecur32.NewProc("InitializeSecurityContextW")
+	procCompleteAuthToken          = modsecur32.NewProc("CompleteAuthToken")
+	procDeleteSecurityContext      = modsecur32.NewProc("DeleteSecurityContext")
+	procFreeCredentialsHandle      = modsecur32.NewProc("FreeCredentialsHandle")
+	procFreeContextBuffer          = modsecur32.NewProc("FreeContextBuffer")
+)
+
+const (
+	secpkgCredOutbound      = 2
+	securityNativeDrep      = 0x10
+	secbufferVersion        = 0
+	secbufferToken          = 2
+	iscReqAllocateMemory    = 0x100
+	iscReqConnection        = 0x800
+	secEOK                  = 0
+	secIContinueNeeded      = 0x00090312
+	secICompleteNeeded      = 0x00090313
+	secICompleteAndContinue = 0x00090314
+)
+
+type secHandle struct {
+	lower, upper uintptr
+}
+
+type secBuffer struct {
+	size       uint32
+	bufferType uint32
+	buffer     *byte
+}
+
+type secBufferDesc struct {
+	version uint32
+	count   uint32
+	buffers *secBuffer
+}
+
+// SSPIAuthenticator returns an Authenticator for Windows integrated
+// authentication with the SSPI security package pkg, "Negotiate" or
+// "NTLM", as the user the process runs as. An empty pkg means
+// "Negotiate", which picks Kerberos or NTLM as the server allows. For a
+// pipe on another machine, Kerberos needs the server to be registered
+// under the service principal name HTTP/ and its host name.
+func SSPIAuthenticator(pkg string) (Authenticator, error) {
+	if pkg == "" {
+		pkg = "Negotiate"
+	}
+	if err := modsecur32.Load(); err != nil {
+		return nil, err
+	}
+	return sspiAuthenticator{pkg: pkg}, nil
+}
+
+type sspiAuthenticator struct {
+	pkg string
+}
+
+func (a sspiAuthenticator) Scheme() string {
+	return a.pkg
+}
+
+func (a sspiAuthenticator) NewSession(serviceName, pipeName string) (AuthSession, error) {
+	pkg, err := windows.UTF16PtrFromString(a.pkg)
+	if err != nil {
+		return nil, err
+	}
+	s := &sspiSession{}
+	if host, remote := pipeHost(pipeName); remote {
+		if s.target, err = windows.UTF16PtrFromString("HTTP/" + host); err != nil {
+			return nil, err
+		}
+	}
+	var expiry int64
+	r, _, _ := procAcquireCredentialsHandleW.Call(
+		0, uintptr(unsafe.Pointer(pkg)), secpkgCredOutbound, 0, 0, 0, 0,
+		uintptr(unsafe.Pointer(&s.cred)), uintptr(unsafe.Pointer(&expiry)))
+	if r != secEOK {
+		return nil, fmt.Errorf("AcquireCredentialsHandle: %w", windows.Errno(r))
+	}
+	return s, nil
+}
+
+// sspiSession is the security context of one handshake.
+type sspiSession struct {
+	cred    secHandle
+	ctx     secHandle
+	started bool
+	target  *uint16
+}
+
+func (s *sspiSession) Step(challenge []byte) ([]byte, error) {
+	var in *secBufferDesc
+	if len(challenge) > 0 {
+		in = &secBufferDesc{
+			version: secbufferVersion,
+			count:   1,
+			buffers: &secBuffer{size: uint32(len(challenge)), bufferType: secbufferToken, buffer: &challenge[0]},
+		}
+	}
+	outBuf := secBuffer{bufferType: secbufferToken}
+	out := secBufferDesc{version: secbufferVersion, count: 1, buffers: &outBuf}
+	var prev *secHandle
+	if s.started {
+		prev = &s.ctx
+	}
+	var attrs uint32
+	var expiry int64
+	r, _, _ := procInitializeSecurityContextW.Call(
+		uintptr(unsafe.Pointer(&s.cred)), uintptr(unsafe.Pointer(prev)), uintptr(unsafe.Pointer(s.target)),
+		iscReqAllocateMemory|iscReqConnection, 0, securityNativeDrep, uintptr(unsafe.Pointer(in)), 0,
+		uintptr(unsafe.Pointer(&s.ctx)), uintptr(unsafe.Pointer(&out)),
+		uintptr(unsafe.Pointer(&attrs)), uintptr(unsafe.Pointer(&expiry)))
+	if outBuf.buffer != nil {
+		defer procFreeContextBuffer.Call(uintptr(unsafe.Pointer(outBuf.buffer)))
+	}
+	switch r {
+	case secEOK, secIContinueNeeded:
+	case secICompleteNeeded, secICompleteAndContinue:
+		if r, _, _ := procCompleteAuthToken.Call(uintptr(unsafe.Pointer(&s.ctx)), uintptr(unsafe.Pointer(&out))); r != secEOK {
+			return nil, fmt.Errorf("CompleteAuthToken: %w", windows.Errno(r))
+		}
+	default:
+		return nil, fmt.Errorf("InitializeSecurityContext: %w", windows.Errno(r))
+	}
+	s.started = true
+	if outBuf.buffer == nil {
+		return nil, nil
+	}
+	return append([]byte(nil), unsafe.Slice(outBuf.buffer, outBuf.size)...), nil
+}
+
+func (s *sspiSession) Close() error {
+	if s.started {
+		procDeleteSecurityContext.Call(uintptr(unsafe.Pointer(&s.ctx)))
+	}
+	procFreeCredentialsHandle.Call(uintptr(unsafe.Pointer(&s.cred)))
+	return nil
+}
@@ -0,0 +1,45 @@
+/*
+   Copyright 2018 Docker, Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package httpnpipe
+
+import "context"
+
+type streamingKey struct{}
+
+// WithStreaming returns a copy of ctx that marks a request made with it as
+// one for a response that streams for as long as the server likes, such
+// as Server-Sent Events or docker events. Once its headers are in, such a
+// response is read with no timeout other than the request context, where
+// BodyReadTimeout would cut off a quiet stream, and without gzip, whose
+// decompression could hold back events until more arrive. Each read
+// returns what the server has sent so far.
+func WithStreaming(ctx context.Context) context.Context {
+	return context.WithValue(ctx, streamingKey{}, true)
+}
+
+// WithStreamingService makes every request to a service a streaming one,
+// as WithStreaming does for a single request.
+func WithStreamingService() RegisterOption {
+	return func(r *registration) {
+		r.streaming = true
+	}
+}
+
+func isStreaming(ctx context.Context) bool {
+	streaming, _ := ctx.Value(streamingKey{}).(bool)
+	return streaming
+}
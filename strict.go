@@ -0,0 +1,67 @@
+/*
+   Copyright 2018 Docker, Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package httpnpipe
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// checkStrictHeader applies the StrictParsing rules to raw, the bytes read
+// off the connection for one response, starting at its status line.
+// http.ReadResponse has already accepted them, but leniently: it takes bare
+// LF line endings and folded header lines, and when a response carries
+// both Content-Length and Transfer-Encoding it silently drops the former.
+// Each of those leaves room for the client and an intermediary to disagree
+// on where the response ends.
+func checkStrictHeader(raw []byte) error {
+	end := bytes.Index(raw, []byte("\r\n\r\n"))
+	if end < 0 {
+		return fmt.Errorf("%w: header not terminated by CRLF CRLF", ErrMalformedResponse)
+	}
+	head := raw[:end]
+	for i, c := range head {
+		if c == '\r' && (i+1 == len(head) || head[i+1] != '\n') {
+			return fmt.Errorf("%w: bare CR in header", ErrMalformedResponse)
+		}
+		if c == '\n' && (i == 0 || head[i-1] != '\r') {
+			return fmt.Errorf("%w: bare LF in header", ErrMalformedResponse)
+		}
+	}
+
+	var contentLengths, transferEncodings int
+	lines := bytes.Split(head, []byte("\r\n"))
+	for _, line := range lines[1:] {
+		if len(line) > 0 && (line[0] == ' ' || line[0] == '\t') {
+			return fmt.Errorf("%w: folded header line", ErrMalformedResponse)
+		}
+		name, _, _ := bytes.Cut(line, []byte(":"))
+		switch {
+		case bytes.EqualFold(name, []byte("Content-Length")):
+			contentLengths++
+		case bytes.EqualFold(name, []byte("Transfer-Encoding")):
+			transferEncodings++
+		}
+	}
+	if contentLengths > 1 {
+		return fmt.Errorf("%w: repeated Content-Length", ErrMalformedResponse)
+	}
+	if contentLengths > 0 && transferEncodings > 0 {
+		return fmt.Errorf("%w: both Content-Length and Transfer-Encoding", ErrMalformedResponse)
+	}
+	return nil
+}
@@ -0,0 +1,130 @@
+/*
+   Copyright 2018 Docker, Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package httpnpipe
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+)
+
+// DefaultTakeoverTimeout is the TakeoverTimeout of a Server that sets
+// none.
+const DefaultTakeoverTimeout = 30 * time.Second
+
+// takeoverPath is where a Server with TakeoverPipe set takes the requests
+// of newer Servers for its pipes.
+const takeoverPath = "/_httpnpipe/takeover"
+
+func (srv *Server) takeoverTimeout() time.Duration {
+	if srv.TakeoverTimeout > 0 {
+		return srv.TakeoverTimeout
+	}
+	return DefaultTakeoverTimeout
+}
+
+// takeOver asks the Server holding the pipe ep, which srv failed to create
+// with listenErr, to hand it over, and then creates it. The pipe only goes
+// once every connection to the older Server has closed, so takeOver keeps
+// trying for a little longer than that Server may take.
+func (srv *Server) takeOver(ep endpoint, listenErr error) (net.Listener, error) {
+	if err := srv.requestTakeover(ep.name); err != nil {
+		return nil, fmt.Errorf("%w; taking it over failed: %v", listenErr, err)
+	}
+	deadline := time.Now().Add(srv.takeoverTimeout() + 5*time.Second)
+	for {
+		l, err := srv.listen(ep)
+		if err == nil || time.Now().After(deadline) {
+			return l, err
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// requestTakeover asks the Server on pipeName, set up like srv, to hand it
+// over.
+func (srv *Server) requestTakeover(pipeName string) error {
+	transport := &Transport{}
+	defer transport.Close()
+	var opts []RegisterOption
+	if srv.NegotiateProtocols {
+		opts = append(opts, WithProtocolNegotiation())
+	}
+	if err := transport.RegisterTargetServiceErr("server", pipeName, opts...); err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, Scheme+"://server"+takeoverPath, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("server answered %s", resp.Status)
+	}
+	return nil
+}
+
+// takeoverHandler answers the takeover requests to srv, which only the
+// user srv runs as may make, and passes the others on to handler.
+func (srv *Server) takeoverHandler(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != takeoverPath || r.Method != http.MethodPost {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		client, ok := ClientIdentityFromContext(r.Context())
+		sid, err := currentUserSID()
+		if !ok || err != nil || client.SID != sid {
+			http.Error(w, "takeover not allowed", http.StatusForbidden)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		srv.handOver()
+	})
+}
+
+// handOver shuts srv down for a newer Server to take its pipes, unless it
+// is doing so already.
+func (srv *Server) handOver() {
+	srv.mutex.Lock()
+	defer srv.mutex.Unlock()
+	if srv.handover != nil {
+		return
+	}
+	handover := make(chan struct{})
+	srv.handover = handover
+	go func() {
+		defer close(handover)
+		ctx, cancel := context.WithTimeout(context.Background(), srv.takeoverTimeout())
+		defer cancel()
+		srv.Shutdown(ctx)
+	}()
+}
+
+// handedOver returns a channel closed once srv has finished handing over
+// its pipes, or nil if it is not handing them over.
+func (srv *Server) handedOver() <-chan struct{} {
+	srv.mutex.Lock()
+	defer srv.mutex.Unlock()
+	return srv.handover
+}
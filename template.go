@@ -0,0 +1,70 @@
+/*
+   Copyright 2018 Docker, Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package httpnpipe
+
+import (
+	"fmt"
+	"strings"
+)
+
+// serviceVar is replaced by the service name in a pipe template.
+const serviceVar = "{service}"
+
+// SetPipeTemplate makes services that have not been registered go to the
+// pipe named by template, with {service} replaced by the service name:
+// given \\.\pipe\myapp-{service}, requests for http+npipe://worker/ go to
+// \\.\pipe\myapp-worker. The template takes precedence over the default
+// pipe. Only service names made of ASCII letters, digits, '-', '_' and '.',
+// and not starting with '.', are expanded, so a URL cannot reach pipes
+// outside the template's pattern. An empty template removes it again.
+func (transport *Transport) SetPipeTemplate(template string) error {
+	return transport.Registry().SetPipeTemplate(template)
+}
+
+// SetPipeTemplate sets the pipe template of the Registry, as described for
+// Transport.SetPipeTemplate.
+func (reg *Registry) SetPipeTemplate(template string) error {
+	if template != "" && !strings.Contains(template, serviceVar) {
+		return fmt.Errorf("http+npipe: pipe template %q lacks %s", template, serviceVar)
+	}
+	reg.mutex.Lock()
+	defer reg.unlockAndNotify()
+	if reg.currentLocked().pipeTemplate != template {
+		reg.updateLocked(func(r *routes) {
+			r.pipeTemplate = template
+		})
+	}
+	return nil
+}
+
+// isTemplateService reports whether service may be put into a pipe
+// template.
+func isTemplateService(service string) bool {
+	if service == "" || service[0] == '.' {
+		return false
+	}
+	for i := 0; i < len(service); i++ {
+		c := service[i]
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		case c == '-' || c == '_' || c == '.':
+		default:
+			return false
+		}
+	}
+	return true
+}
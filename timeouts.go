@@ -0,0 +1,75 @@
+/*
+   Copyright 2018 Docker, Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package httpnpipe
+
+import (
+	"context"
+	"time"
+)
+
+// Timeouts overrides the timeouts of a Transport for the requests made with
+// a context from WithTimeouts. The fields mean the same as the Transport
+// fields of the same name. A zero field leaves the Transport's setting in
+// place, and a negative one disables that timeout.
+type Timeouts struct {
+	DialTimeout           time.Duration
+	RequestTimeout        time.Duration
+	ResponseHeaderTimeout time.Duration
+	HeaderWriteTimeout    time.Duration
+	BodyWriteTimeout      time.Duration
+	BodyReadTimeout       time.Duration
+	ExpectContinueTimeout time.Duration
+}
+
+type timeoutsKey struct{}
+
+// WithTimeouts returns a copy of ctx that carries timeouts, so that a single
+// request can depart from the Transport's timeouts without the Transport
+// being changed or copied.
+func WithTimeouts(ctx context.Context, timeouts Timeouts) context.Context {
+	return context.WithValue(ctx, timeoutsKey{}, timeouts)
+}
+
+// timeouts returns the timeouts that apply to a request made with ctx.
+func (transport *Transport) timeouts(ctx context.Context) Timeouts {
+	t := Timeouts{
+		DialTimeout:           transport.DialTimeout,
+		RequestTimeout:        transport.RequestTimeout,
+		ResponseHeaderTimeout: transport.ResponseHeaderTimeout,
+		HeaderWriteTimeout:    transport.HeaderWriteTimeout,
+		BodyWriteTimeout:      transport.BodyWriteTimeout,
+		BodyReadTimeout:       transport.BodyReadTimeout,
+		ExpectContinueTimeout: transport.ExpectContinueTimeout,
+	}
+	override, ok := ctx.Value(timeoutsKey{}).(Timeouts)
+	if !ok {
+		return t
+	}
+	set := func(d *time.Duration, o time.Duration) {
+		if o != 0 {
+			*d = o
+		}
+	}
+	set(&t.DialTimeout, override.DialTimeout)
+	set(&t.RequestTimeout, override.RequestTimeout)
+	set(&t.ResponseHeaderTimeout, override.ResponseHeaderTimeout)
+	set(&t.HeaderWriteTimeout, override.HeaderWriteTimeout)
+	set(&t.BodyWriteTimeout, override.BodyWriteTimeout)
+	set(&t.BodyReadTimeout, override.BodyReadTimeout)
+	set(&t.ExpectContinueTimeout, override.ExpectContinueTimeout)
+	return t
+}
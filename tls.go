@@ -0,0 +1,55 @@
+/*
+   Copyright 2018 Docker, Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package httpnpipe
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+)
+
+// tlsConfig returns the TLS configuration for connections to service,
+// offering protocols through ALPN.
+func (transport *Transport) tlsConfig(service string, protocols ...string) *tls.Config {
+	cfg := transport.TLSClientConfig.Clone()
+	if cfg == nil {
+		cfg = &tls.Config{}
+	}
+	if cfg.ServerName == "" {
+		cfg.ServerName = service
+	}
+	if len(cfg.NextProtos) == 0 {
+		cfg.NextProtos = protocols
+	}
+	return cfg
+}
+
+// handshake runs TLS over c, a connection to service on pipeName, within
+// the dial timeout. It closes c if the handshake fails.
+func (transport *Transport) handshake(ctx context.Context, c net.Conn, service, pipeName string, protocols ...string) (*tls.Conn, error) {
+	if timeout := transport.timeouts(ctx).DialTimeout; timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	tlsConn := tls.Client(c, transport.tlsConfig(service, protocols...))
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		c.Close()
+		return nil, &DialError{Service: service, Pipe: pipeName, Err: err}
+	}
+	return tlsConn, nil
+}
@@ -0,0 +1,78 @@
+/*
+   Copyright 2018 Docker, Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package httpnpipe
+
+import (
+	"fmt"
+	"time"
+)
+
+// RegisterTargetServiceTTL is like RegisterTargetServiceErr, but the mapping
+// only lasts for ttl, which suits pipes created for a single session. When
+// it expires the service is unregistered as by UnregisterTargetService.
+// Registering or replacing the service again before then cancels the
+// expiry.
+func (transport *Transport) RegisterTargetServiceTTL(serviceName string, pipeName string, ttl time.Duration) error {
+	return transport.Registry().RegisterTTL(serviceName, pipeName, ttl)
+}
+
+// RegisterTTL is like Register, but the mapping only lasts for ttl.
+// Registering or replacing the service again before then cancels the
+// expiry.
+func (reg *Registry) RegisterTTL(serviceName string, pipeName string, ttl time.Duration) error {
+	if ttl <= 0 {
+		return fmt.Errorf("http+npipe: non-positive TTL %v for service %q", ttl, serviceName)
+	}
+	reg.mutex.Lock()
+	defer reg.unlockAndNotify()
+	if reg.currentLocked().registered(serviceName) {
+		return fmt.Errorf("%w: %q", ErrServiceRegistered, serviceName)
+	}
+	reg.setPipeLocked(serviceName, pipeName)
+	e := &expiry{}
+	e.timer = time.AfterFunc(ttl, func() {
+		reg.expireService(serviceName, e)
+	})
+	if reg.expiries == nil {
+		reg.expiries = make(map[string]*expiry)
+	}
+	reg.expiries[serviceName] = e
+	return nil
+}
+
+// expiry is the pending removal of a service registered with a TTL.
+type expiry struct {
+	timer *time.Timer
+}
+
+// expireService unregisters serviceName, unless e has been stopped or
+// replaced since its timer fired.
+func (reg *Registry) expireService(serviceName string, e *expiry) {
+	reg.mutex.Lock()
+	defer reg.unlockAndNotify()
+	if reg.expiries[serviceName] != e {
+		return
+	}
+	reg.unregisterLocked(serviceName)
+}
+
+func (reg *Registry) stopExpiryLocked(serviceName string) {
+	if e, ok := reg.expiries[serviceName]; ok {
+		e.timer.Stop()
+		delete(reg.expiries, serviceName)
+	}
+}
@@ -0,0 +1,37 @@
+/*
+   Copyright 2018 Docker, Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package httpnpipe
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// isPipeName reports whether target, what a service is mapped to, names a
+// pipe, as \\.\pipe\name or \\host\pipe\name do, rather than giving the
+// path of a Unix domain socket.
+func isPipeName(target string) bool {
+	return len(target) >= 2 && isPathSeparator(target[0]) && isPathSeparator(target[1])
+}
+
+// dialUnix connects to the Unix domain socket at path, which Windows has
+// too, giving up early if ctx is done first.
+func dialUnix(ctx context.Context, path string, timeout time.Duration) (net.Conn, error) {
+	d := net.Dialer{Timeout: timeout}
+	return d.DialContext(ctx, "unix", path)
+}
@@ -0,0 +1,140 @@
+/*
+   Copyright 2018 Docker, Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package httpnpipe
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// isUpgrade reports whether req asks the server to switch the connection
+// to another protocol, as a WebSocket handshake does.
+func isUpgrade(req *http.Request) bool {
+	return hasToken(req.Header, "Connection", "upgrade") && req.Header.Get("Upgrade") != ""
+}
+
+// isTunnel reports whether resp opens the tunnel asked for by the CONNECT
+// request req.
+func isTunnel(req *http.Request, resp *http.Response) bool {
+	return req.Method == http.MethodConnect && resp.StatusCode/100 == 2
+}
+
+// upgradedBody is the body of a 101 Switching Protocols response, or of a
+// successful response to CONNECT: the connection itself, which the caller
+// now speaks the new protocol over, or tunnels through.
+// As with net/http, it is an io.ReadWriteCloser, and it is a net.Conn
+// besides, for WebSocket libraries and the like that want one. It stays
+// bound to the request context, and the connection is never reused.
+type upgradedBody struct {
+	pc    *persistConn
+	stop  func() bool
+	watch *streamWatch // for StreamKeepAlive
+}
+
+func (b *upgradedBody) Read(p []byte) (int, error) {
+	n, err := b.pc.br.Read(p)
+	if err != nil {
+		err = b.watch.failed(err)
+	}
+	return n, err
+}
+
+func (b *upgradedBody) Write(p []byte) (int, error) {
+	n, err := b.pc.conn.Write(p)
+	if err != nil {
+		err = b.watch.failed(err)
+	}
+	return n, err
+}
+
+// CloseWrite shuts down the writing side of the connection, where the pipe
+// supports that.
+func (b *upgradedBody) CloseWrite() error {
+	return closeWrite(b.pc.conn)
+}
+
+func (b *upgradedBody) Close() error {
+	b.watch.close()
+	b.stop()
+	b.pc.close()
+	return nil
+}
+
+func (b *upgradedBody) LocalAddr() net.Addr {
+	return b.pc.conn.LocalAddr()
+}
+
+func (b *upgradedBody) RemoteAddr() net.Addr {
+	return b.pc.conn.RemoteAddr()
+}
+
+func (b *upgradedBody) SetDeadline(t time.Time) error {
+	return b.pc.conn.SetDeadline(t)
+}
+
+func (b *upgradedBody) SetReadDeadline(t time.Time) error {
+	return b.pc.conn.SetReadDeadline(t)
+}
+
+func (b *upgradedBody) SetWriteDeadline(t time.Time) error {
+	return b.pc.conn.SetWriteDeadline(t)
+}
+
+// UpgradedConn returns the connection of a 101 Switching Protocols
+// response from a Transport, for the caller to speak the protocol switched
+// to over it, as with WebSocket or docker attach, or of a successful
+// response to CONNECT, for the caller to tunnel through. Data the server
+// sent after the response headers has not been lost: it is read first. It
+// reports false for any other response. The connection stays bound to the
+// context of the request, which must therefore last as long as it does.
+func UpgradedConn(resp *http.Response) (net.Conn, bool) {
+	if resp.StatusCode != http.StatusSwitchingProtocols && (resp.Request == nil || !isTunnel(resp.Request, resp)) {
+		return nil, false
+	}
+	conn, ok := resp.Body.(net.Conn)
+	return conn, ok
+}
+
+// Tunnel asks serviceName, a proxy or gateway, to open a tunnel to target,
+// a host and port such as example.com:443, with a CONNECT request, and
+// returns the connection through it. The connection stays bound to ctx. If
+// the service refuses, Tunnel returns an error wrapping ErrTunnelRefused. To
+// send headers with the request, such as for proxy authentication, send it
+// with RoundTrip instead, with the service in its URL and target as its
+// Host, and take the connection with UpgradedConn.
+func (transport *Transport) Tunnel(ctx context.Context, serviceName, target string) (net.Conn, error) {
+	req := (&http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Scheme: Scheme, Host: serviceName},
+		Host:   target,
+		Header: make(http.Header),
+	}).WithContext(ctx)
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	conn, ok := UpgradedConn(resp)
+	if !ok {
+		resp.Body.Close()
+		return nil, fmt.Errorf("%w: %s to %s: %s", ErrTunnelRefused, serviceName, target, resp.Status)
+	}
+	return conn, nil
+}
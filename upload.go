@@ -0,0 +1,97 @@
+/*
+   Copyright 2018 Docker, Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package httpnpipe
+
+import (
+	"context"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"sync"
+)
+
+// NewUploadRequest returns a request whose body write produces while the
+// Transport sends it, for uploads too big to hold in memory, such as the
+// build context of docker build. write runs in a goroutine of its own once
+// the body is first read. Each of its writes waits for the Transport to
+// take the data, which goes out to the pipe before more is asked for, so
+// no more than one write's worth is held at a time, and a server that
+// reads slowly slows write down. The body is sent chunked. If the request
+// ends before all of the body is sent, as on a BodyWriteTimeout, write's
+// writes fail with the reason; if write returns an error, the request
+// fails with it.
+func NewUploadRequest(ctx context.Context, method, url string, write func(w io.Writer) error) (*http.Request, error) {
+	pr, pw := io.Pipe()
+	return newUploadRequest(ctx, method, url, &uploadBody{pr: pr, pw: pw, write: write})
+}
+
+// NewMultipartRequest is NewUploadRequest for a multipart/form-data body,
+// which write writes part by part with mw. The request's Content-Type
+// carries the boundary, and the closing boundary is written once write
+// returns.
+func NewMultipartRequest(ctx context.Context, method, url string, write func(mw *multipart.Writer) error) (*http.Request, error) {
+	pr, pw := io.Pipe()
+	mw := multipart.NewWriter(pw)
+	req, err := newUploadRequest(ctx, method, url, &uploadBody{pr: pr, pw: pw, write: func(io.Writer) error {
+		if err := write(mw); err != nil {
+			return err
+		}
+		return mw.Close()
+	}})
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	return req, nil
+}
+
+func newUploadRequest(ctx context.Context, method, url string, body *uploadBody) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Body = body
+	req.ContentLength = -1
+	return req, nil
+}
+
+// uploadBody is the body of a request from NewUploadRequest.
+type uploadBody struct {
+	pr    *io.PipeReader
+	pw    *io.PipeWriter
+	write func(w io.Writer) error
+	once  sync.Once
+}
+
+func (b *uploadBody) Read(p []byte) (int, error) {
+	b.once.Do(func() {
+		go func() { b.pw.CloseWithError(b.write(b.pw)) }()
+	})
+	return b.pr.Read(p)
+}
+
+// Close ends the upload. If write is still running, its writes fail.
+func (b *uploadBody) Close() error {
+	return b.closeWithError(nil)
+}
+
+// closeWithError ends the upload, failing any writes still to come with
+// err, or io.ErrClosedPipe if err is nil.
+func (b *uploadBody) closeWithError(err error) error {
+	b.once.Do(func() {})
+	return b.pr.CloseWithError(err)
+}
@@ -0,0 +1,85 @@
+/*
+   Copyright 2018 Docker, Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package httpnpipe
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// validateRequest applies the checks net/http.Transport makes before it
+// touches the network, so that a request which could never be written
+// fails without taking up a pipe connection.
+func validateRequest(req *http.Request) error {
+	if req.Header == nil {
+		return fmt.Errorf("%w: nil Request.Header", ErrInvalidRequest)
+	}
+	if req.Method != "" && !isToken(req.Method) {
+		return fmt.Errorf("%w: invalid method %q", ErrInvalidRequest, req.Method)
+	}
+	if req.Body == nil && req.ContentLength > 0 {
+		return fmt.Errorf("%w: Request.ContentLength=%d with nil Body", ErrInvalidRequest, req.ContentLength)
+	}
+	for k, vv := range req.Header {
+		if !isToken(k) {
+			return fmt.Errorf("%w: invalid header field name %q", ErrInvalidRequest, k)
+		}
+		for _, v := range vv {
+			if !isFieldValue(v) {
+				// Don't include the value in the error, it may be
+				// sensitive.
+				return fmt.Errorf("%w: invalid header field value for %q", ErrInvalidRequest, k)
+			}
+		}
+	}
+	return nil
+}
+
+// closeBody closes the body of a request that is failed before it could
+// be written, as a RoundTripper must.
+func closeBody(req *http.Request) {
+	if req.Body != nil {
+		req.Body.Close()
+	}
+}
+
+// isToken reports whether s is a token as defined by RFC 7230, section
+// 3.2.6.
+func isToken(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c >= 0x80 || c <= ' ' || c == 0x7f || strings.IndexByte(`"(),/:;<=>?@[\]{}`, c) >= 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// isFieldValue reports whether s can be sent as a header field value:
+// no control characters other than horizontal tab.
+func isFieldValue(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; (c < ' ' && c != '\t') || c == 0x7f {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,41 @@
+/*
+   Copyright 2018 Docker, Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package httpnpipe
+
+import "context"
+
+// VerifyPipe checks that pipeName, meant for serviceName, can be connected
+// to, within the Transport's DialTimeout and the lifetime of ctx. It
+// returns a *DialError if not. The connection it makes is closed again
+// straight away, which the server sees as a client that sent nothing.
+func (transport *Transport) VerifyPipe(ctx context.Context, serviceName string, pipeName string) error {
+	c, err := transport.dialRaw(ctx, serviceName, pipeName)
+	if err != nil {
+		return err
+	}
+	c.Close()
+	return nil
+}
+
+// RegisterAndVerify registers serviceName as RegisterTargetServiceErr does,
+// after checking with VerifyPipe that pipeName can be connected to.
+func (transport *Transport) RegisterAndVerify(ctx context.Context, serviceName string, pipeName string, opts ...RegisterOption) error {
+	if err := transport.VerifyPipe(ctx, serviceName, pipeName); err != nil {
+		return err
+	}
+	return transport.Registry().Register(serviceName, pipeName, opts...)
+}
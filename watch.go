@@ -0,0 +1,101 @@
+/*
+   Copyright 2018 Docker, Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package httpnpipe
+
+import (
+	"context"
+	"os"
+	"time"
+)
+
+// configPollInterval is how often WatchConfig checks its file for changes.
+const configPollInterval = time.Second
+
+// WatchConfig registers the services listed in the config file at path, as
+// LoadServices does, and then keeps them in step with the file until ctx is
+// done. When the file changes, the services it no longer lists are
+// unregistered and the rest replaced in one step, so a request sees either
+// the old mappings or the new ones; the connections of removed or remapped
+// services are closed as by UnregisterTargetService and
+// ReplaceTargetService. A change that leaves the file unreadable or
+// malformed is ignored, keeping the mappings as they were.
+//
+// Services registered with the Transport by other means are left alone,
+// unless the file names them.
+func (transport *Transport) WatchConfig(ctx context.Context, path string) error {
+	return transport.Registry().WatchConfig(ctx, path)
+}
+
+// WatchConfig loads the config file at path, as LoadServices does, and
+// then keeps the Registry in step with the file until ctx is done, as
+// described for Transport.WatchConfig.
+func (reg *Registry) WatchConfig(ctx context.Context, path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	config, err := ReadConfig(path)
+	if err != nil {
+		return err
+	}
+	if err := reg.loadConfig(config); err != nil {
+		return err
+	}
+	go reg.watchConfig(ctx, path, info, config)
+	return nil
+}
+
+func (reg *Registry) watchConfig(ctx context.Context, path string, info os.FileInfo, config *Config) {
+	ticker := time.NewTicker(configPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		latest, err := os.Stat(path)
+		if err != nil || (latest.ModTime().Equal(info.ModTime()) && latest.Size() == info.Size()) {
+			continue
+		}
+		next, err := ReadConfig(path)
+		if err != nil {
+			continue
+		}
+		info = latest
+		reg.applyConfig(config, next)
+		config = next
+	}
+}
+
+// applyConfig moves the Registry from the mappings of prev to those of
+// next.
+func (reg *Registry) applyConfig(prev *Config, next *Config) {
+	reg.mutex.Lock()
+	defer reg.unlockAndNotify()
+	for service, pipeName := range prev.Services {
+		if _, kept := next.Services[service]; !kept && reg.currentLocked().pipes[service] == pipeName {
+			reg.unregisterLocked(service)
+		}
+	}
+	for service, pipeName := range next.Services {
+		reg.setPipeLocked(service, pipeName)
+	}
+	if next.DefaultPipe != "" || reg.currentLocked().defaultPipe == prev.DefaultPipe {
+		reg.setDefaultPipeLocked(next.DefaultPipe)
+	}
+}
@@ -0,0 +1,140 @@
+/*
+   Copyright 2018 Docker, Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package httpnpipe
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// DefaultWSLRelay is the relay usually set as Transport.WSLRelay:
+// npiperelay, found on the PATH that WSL shares with Windows.
+const DefaultWSLRelay = "npiperelay.exe"
+
+// IsWSL reports whether the program runs inside the Windows Subsystem for
+// Linux, where Windows runs alongside and its programs can be started, but
+// its named pipes cannot be opened.
+func IsWSL() bool {
+	return isWSL()
+}
+
+var isWSL = sync.OnceValue(func() bool {
+	if runtime.GOOS != "linux" {
+		return false
+	}
+	if os.Getenv("WSL_DISTRO_NAME") != "" {
+		return true
+	}
+	_, err := os.Stat("/proc/sys/fs/binfmt_misc/WSLInterop")
+	return err == nil
+})
+
+// usesWSLRelay reports whether pipes are dialed through WSLRelay.
+func (transport *Transport) usesWSLRelay() bool {
+	return transport.WSLRelay != "" && isWSL()
+}
+
+// dialWSLRelay reaches pipeName, a pipe on the Windows side, by starting
+// WSLRelay for it, going by DenyRemotePipes as dialRemotePipe does.
+func (transport *Transport) dialWSLRelay(ctx context.Context, pipeName string) (net.Conn, error) {
+	if host, remote := pipeHost(pipeName); remote {
+		if !isValidPipeHost(host) {
+			return nil, fmt.Errorf("%w: bad host %q", ErrInvalidPipeName, host)
+		}
+		if transport.DenyRemotePipes {
+			return nil, fmt.Errorf("%w: %q", ErrRemotePipeDenied, pipeName)
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	// The relay ends once the pipe is closed on the far side (-ep), and
+	// half-closes it when its input ends (-s), for CloseWrite.
+	cmd := exec.Command(transport.WSLRelay, "-ep", "-s", pipeName)
+	stdinR, stdinW, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	stdoutR, stdoutW, err := os.Pipe()
+	if err != nil {
+		stdinR.Close()
+		stdinW.Close()
+		return nil, err
+	}
+	cmd.Stdin = stdinR
+	cmd.Stdout = stdoutW
+	err = cmd.Start()
+	stdinR.Close()
+	stdoutW.Close()
+	if err != nil {
+		stdinW.Close()
+		stdoutR.Close()
+		return nil, err
+	}
+	return &relayConn{r: stdoutR, w: stdinW, cmd: cmd, pipeName: pipeName}, nil
+}
+
+// relayConn is a connection to a pipe through a relay process, read from
+// its standard output and written to its standard input.
+type relayConn struct {
+	r, w     *os.File
+	cmd      *exec.Cmd
+	pipeName string
+
+	closeOnce sync.Once
+}
+
+func (c *relayConn) Read(p []byte) (int, error)  { return c.r.Read(p) }
+func (c *relayConn) Write(p []byte) (int, error) { return c.w.Write(p) }
+
+// CloseWrite ends the relay's input, which half-closes the pipe.
+func (c *relayConn) CloseWrite() error { return c.w.Close() }
+
+func (c *relayConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.w.Close()
+		c.r.Close()
+		c.cmd.Process.Kill()
+		go c.cmd.Wait()
+	})
+	return nil
+}
+
+func (c *relayConn) LocalAddr() net.Addr  { return relayAddr(c.pipeName) }
+func (c *relayConn) RemoteAddr() net.Addr { return relayAddr(c.pipeName) }
+
+func (c *relayConn) SetDeadline(t time.Time) error {
+	if err := c.r.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.w.SetWriteDeadline(t)
+}
+
+func (c *relayConn) SetReadDeadline(t time.Time) error  { return c.r.SetReadDeadline(t) }
+func (c *relayConn) SetWriteDeadline(t time.Time) error { return c.w.SetWriteDeadline(t) }
+
+// relayAddr is the address of both ends of a relayConn: the pipe.
+type relayAddr string
+
+func (a relayAddr) Network() string { return "pipe" }
+func (a relayAddr) String() string  { return string(a) }